@@ -1,6 +1,8 @@
 package server
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/fornellas/mdns-proxy/log"
 	"github.com/fornellas/mdns-proxy/server"
+	"github.com/fornellas/mdns-proxy/version"
 )
 
 var baseDomain string
@@ -21,6 +24,9 @@ var baseDomain string
 var defaultAddr = ":7234"
 var addr string
 
+var defaultPublicPort uint16 = 0
+var publicPort uint16
+
 var defaultService = "_http._tcp"
 var service string
 
@@ -39,6 +45,243 @@ var disableIPv4 bool
 var defaultDisableIPv6 = false
 var disableIPv6 bool
 
+var defaultRoutingMode = server.RoutingSubdomain
+var routingMode string
+
+var defaultPathPrefix = "/d/"
+var pathPrefix string
+
+var defaultAliases = map[string]string{}
+var aliases map[string]string
+
+var defaultDisplayNames = map[string]string{}
+var displayNames map[string]string
+
+var defaultDescriptions = map[string]string{}
+var descriptions map[string]string
+
+var defaultAliasTxtKey = ""
+var aliasTxtKey string
+
+var defaultAllowHosts = []string{}
+var allowHosts []string
+
+var defaultDenyHosts = []string{}
+var denyHosts []string
+
+var defaultHostPolicyCacheTTL = 30 * time.Second
+var hostPolicyCacheTTL time.Duration
+
+var defaultUpstreamAllowCIDRs = []string{}
+var upstreamAllowCIDRs []string
+
+var defaultUpstreamDenyCIDRs = server.DefaultUpstreamDenyCIDRs
+var upstreamDenyCIDRs []string
+
+var defaultUpstreamDenyLocalAddresses = true
+var upstreamDenyLocalAddresses bool
+
+var defaultUpstreamBindMode = server.UpstreamBindNone
+var upstreamBindMode string
+
+var defaultUpstreamBindInterface = ""
+var upstreamBindInterface string
+
+var defaultUpstreamDialTimeout = 5 * time.Second
+var upstreamDialTimeout time.Duration
+
+var defaultUpstreamIdleTimeout = 30 * time.Second
+var upstreamIdleTimeout time.Duration
+
+var defaultUpstreamResponseHeaderTimeout = 30 * time.Second
+var upstreamResponseHeaderTimeout time.Duration
+
+var defaultUpstreamMaxConnsPerHost = 4
+var upstreamMaxConnsPerHost int
+
+var defaultUpstreamMaxIdleConnsPerHost = 2
+var upstreamMaxIdleConnsPerHost int
+
+var defaultUpstreamMaxRequestsPerHost = 4
+var upstreamMaxRequestsPerHost int
+
+var defaultUpstreamMaxQueuePerHost = 32
+var upstreamMaxQueuePerHost int
+
+var defaultUpstreamQueueTimeout = 10 * time.Second
+var upstreamQueueTimeout time.Duration
+
+var defaultUpstreamHostMaxRequests = map[string]int{}
+var upstreamHostMaxRequests map[string]int
+
+var defaultUpstreamHostMaxQueue = map[string]int{}
+var upstreamHostMaxQueue map[string]int
+
+var defaultRewriteBodyHosts = []string{}
+var rewriteBodyHosts []string
+
+var defaultRewriteBodyContentTypes = server.DefaultBodyRewriteContentTypes
+var rewriteBodyContentTypes []string
+
+var defaultCompress = false
+var compress bool
+
+var defaultCompressEncodings = server.DefaultCompressionEncodings
+var compressEncodings []string
+
+var defaultCompressContentTypes = server.DefaultCompressionContentTypes
+var compressContentTypes []string
+
+var defaultCompressMinSize = 1024
+var compressMinSize int
+
+var defaultCompressDisableHosts = []string{}
+var compressDisableHosts []string
+
+var defaultCache = false
+var cache bool
+
+var defaultCacheMaxSize = int64(64 * 1024 * 1024)
+var cacheMaxSize int64
+
+var defaultCacheMaxEntrySize = int64(4 * 1024 * 1024)
+var cacheMaxEntrySize int64
+
+var defaultCacheDir = ""
+var cacheDir string
+
+var defaultCacheRules = []string{}
+var cacheRules []string
+
+var defaultFlushInterval = time.Duration(0)
+var flushInterval time.Duration
+
+var defaultStreamMaxPerClient = 16
+var streamMaxPerClient int
+
+var defaultStreamMaxPerHost = 4
+var streamMaxPerHost int
+
+var defaultStreamIdleTimeout = 5 * time.Minute
+var streamIdleTimeout time.Duration
+
+var defaultStreamMaxLifetime = 24 * time.Hour
+var streamMaxLifetime time.Duration
+
+var defaultTCPForwards = []string{}
+var tcpForwards []string
+
+var defaultTunnelMaxPerClient = 8
+var tunnelMaxPerClient int
+
+var defaultTunnelMaxPerHost = 16
+var tunnelMaxPerHost int
+
+var defaultTunnelIdleTimeout = 30 * time.Minute
+var tunnelIdleTimeout time.Duration
+
+var defaultForwardProxy = false
+var forwardProxy bool
+
+var defaultSOCKSAddr = ""
+var socksAddr string
+
+var defaultSOCKSUsers = map[string]string{}
+var socksUsers map[string]string
+
+var defaultSOCKSUsersFile = ""
+var socksUsersFile string
+
+var defaultSOCKSNoAuth = false
+var socksNoAuth bool
+
+var defaultSNIAddr = ""
+var sniAddr string
+
+var defaultSNIUpstreamPort = uint16(443)
+var sniUpstreamPort uint16
+
+var defaultSNIHelloTimeout = 5 * time.Second
+var sniHelloTimeout time.Duration
+
+var defaultDNSAddr = ""
+var dnsAddr string
+
+var defaultDNSAnswerAddresses = []string{}
+var dnsAnswerAddresses []string
+
+var defaultDNSTTL = time.Minute
+var dnsTTL time.Duration
+
+var defaultDNSRefreshInterval = 30 * time.Second
+var dnsRefreshInterval time.Duration
+
+var defaultDNSSD = false
+var dnsSD bool
+
+var defaultDNSGateway = false
+var dnsGateway bool
+
+var defaultDNSGatewayAllowCIDRs = server.DefaultDNSGatewayAllowCIDRs
+var dnsGatewayAllowCIDRs []string
+
+var defaultDNSGatewayMaxTTL = time.Minute
+var dnsGatewayMaxTTL time.Duration
+
+var defaultDNSGatewayRateLimit = 50.0
+var dnsGatewayRateLimit float64
+
+var defaultDNSGatewayRecords = []string{}
+var dnsGatewayRecords []string
+
+var defaultReadvertiseInterface = ""
+var readvertiseInterface string
+
+var defaultReadvertiseRefreshInterval = 30 * time.Second
+var readvertiseRefreshInterval time.Duration
+
+var defaultReflectInterfaces = []string{}
+var reflectInterfaces []string
+
+var defaultReflectAllow = []string{}
+var reflectAllow []string
+
+var defaultReflectDeny = []string{}
+var reflectDeny []string
+
+var defaultAdvertise = false
+var advertise bool
+
+var defaultAdvertiseName = "mDNS Proxy"
+var advertiseName string
+
+var defaultAdvertiseInterface = mdns.AnyIface
+var advertiseInterface string
+
+var defaultAdminAddr = ""
+var adminAddr string
+
+var defaultTrustedProxies = []string{}
+var trustedProxies []string
+
+var defaultProxyProtocol = false
+var proxyProtocol bool
+
+var defaultProxyProtocolTrustedCIDRs = []string{}
+var proxyProtocolTrustedCIDRs []string
+
+var defaultProxyProtocolTimeout = 5 * time.Second
+var proxyProtocolTimeout time.Duration
+
+var defaultTLSCertFile = ""
+var tlsCertFile string
+
+var defaultTLSKeyFile = ""
+var tlsKeyFile string
+
+var defaultH2C = false
+var h2c bool
+
 var Cmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start a server that proxies requests to discovered mDNS hosts.",
@@ -48,6 +291,132 @@ var Cmd = &cobra.Command{
 
 		logger := log.GetLogger(ctx)
 
+		routing, err := server.NewRouting(routingMode, pathPrefix)
+		if err != nil {
+			logrus.Fatalf("Invalid routing: %v", err)
+		}
+		if (tlsCertFile == "") != (tlsKeyFile == "") {
+			logrus.Fatal("Invalid TLS configuration: both --tls-cert and --tls-key must be given to enable TLS")
+		}
+		if proxyProtocol && len(proxyProtocolTrustedCIDRs) == 0 {
+			logrus.Fatal("Invalid PROXY protocol configuration: --proxy-protocol requires --proxy-protocol-trusted")
+		}
+
+		hostAliases, err := server.NewHostAliases(
+			mdnsDomain,
+			aliases,
+			displayNames,
+			descriptions,
+			aliasTxtKey,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid aliases: %v", err)
+		}
+
+		hostPolicy, err := server.NewHostPolicy(
+			mdnsDomain,
+			service,
+			allowHosts,
+			denyHosts,
+			hostPolicyCacheTTL,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid host policy: %v", err)
+		}
+
+		upstreamPolicy, err := server.NewUpstreamPolicy(
+			upstreamAllowCIDRs,
+			upstreamDenyCIDRs,
+			upstreamDenyLocalAddresses,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid upstream policy: %v", err)
+		}
+
+		upstreamBinder, err := server.NewUpstreamBinder(
+			upstreamBindMode,
+			upstreamBindInterface,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid upstream binding: %v", err)
+		}
+
+		limiter, err := server.NewLimiter(
+			mdnsDomain,
+			upstreamMaxRequestsPerHost,
+			upstreamMaxQueuePerHost,
+			upstreamQueueTimeout,
+			upstreamHostMaxRequests,
+			upstreamHostMaxQueue,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid upstream limits: %v", err)
+		}
+
+		proxyCache, err := server.NewCache(
+			cache,
+			mdnsDomain,
+			cacheMaxSize,
+			cacheMaxEntrySize,
+			cacheDir,
+			cacheRules,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid cache configuration: %v", err)
+		}
+
+		proxy := server.NewProxy(
+			upstreamPolicy,
+			upstreamBinder,
+			limiter,
+			server.NewBodyRewriter(
+				mdnsDomain,
+				rewriteBodyHosts,
+				rewriteBodyContentTypes,
+			),
+			server.NewStreams(
+				streamMaxPerClient,
+				streamMaxPerHost,
+				streamIdleTimeout,
+				streamMaxLifetime,
+			),
+			proxyCache,
+			flushInterval,
+			upstreamDialTimeout,
+			upstreamIdleTimeout,
+			upstreamResponseHeaderTimeout,
+			upstreamMaxConnsPerHost,
+			upstreamMaxIdleConnsPerHost,
+		)
+		defer proxy.Close()
+
+		serverTrustedProxies, err := server.NewTrustedProxies(trustedProxies)
+		if err != nil {
+			logrus.Fatalf("Invalid trusted proxies: %v", err)
+		}
+
+		compressor, err := server.NewCompressor(
+			compress,
+			mdnsDomain,
+			compressEncodings,
+			compressContentTypes,
+			compressMinSize,
+			compressDisableHosts,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid compression configuration: %v", err)
+		}
+
+		// Each kind of tunnel has its own limits, so one can not use up the others'
+		newTunnelStreams := func() *server.Streams {
+			return server.NewStreams(
+				tunnelMaxPerClient,
+				tunnelMaxPerHost,
+				tunnelIdleTimeout,
+				0,
+			)
+		}
+
 		srv, err := server.NewServer(
 			ctx,
 			addr,
@@ -58,24 +427,336 @@ var Cmd = &cobra.Command{
 			timeout,
 			disableIPv4,
 			disableIPv6,
+			hostAliases,
+			hostPolicy,
+			proxy,
+			serverTrustedProxies,
+			routing,
+			compressor,
+			server.NewForwardProxy(
+				forwardProxy,
+				interfaceStr,
+				mdnsDomain,
+				timeout,
+				disableIPv4,
+				disableIPv6,
+				hostPolicy,
+				upstreamPolicy,
+				upstreamBinder,
+				upstreamDialTimeout,
+				proxy,
+				newTunnelStreams(),
+			),
+			h2c,
 		)
 		if err != nil {
 			logrus.Fatalf("Error starting server: %v", err)
 		}
 
+		tcpForwarder, err := server.NewTCPForwarder(
+			tcpForwards,
+			interfaceStr,
+			mdnsDomain,
+			timeout,
+			disableIPv4,
+			disableIPv6,
+			hostPolicy,
+			upstreamPolicy,
+			upstreamBinder,
+			upstreamDialTimeout,
+			newTunnelStreams(),
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid TCP forwarding configuration: %v", err)
+		}
+
+		sniRouter := server.NewSNIRouter(
+			sniAddr,
+			baseDomain,
+			interfaceStr,
+			service,
+			mdnsDomain,
+			timeout,
+			disableIPv4,
+			disableIPv6,
+			hostAliases,
+			hostPolicy,
+			upstreamPolicy,
+			upstreamBinder,
+			upstreamDialTimeout,
+			sniUpstreamPort,
+			sniHelloTimeout,
+			newTunnelStreams(),
+		)
+
+		allSOCKSUsers := map[string]string{}
+		if socksUsersFile != "" {
+			allSOCKSUsers, err = server.ReadSOCKSUsersFile(socksUsersFile)
+			if err != nil {
+				logrus.Fatalf("Invalid SOCKS users file: %v", err)
+			}
+		}
+		for user, password := range socksUsers {
+			allSOCKSUsers[user] = password
+		}
+		if socksAddr != "" && len(allSOCKSUsers) == 0 && !socksNoAuth {
+			logrus.Fatal("Invalid SOCKS configuration: users must be set with --socks-user or --socks-users-file, or authentication explicitly disabled with --socks-no-auth")
+		}
+		socksServer, err := server.NewSOCKSServer(
+			socksAddr,
+			allSOCKSUsers,
+			interfaceStr,
+			mdnsDomain,
+			timeout,
+			disableIPv4,
+			disableIPv6,
+			hostPolicy,
+			upstreamPolicy,
+			upstreamBinder,
+			upstreamDialTimeout,
+			newTunnelStreams(),
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid SOCKS configuration: %v", err)
+		}
+
+		dnsGw, err := server.NewDNSGateway(
+			dnsGateway,
+			interfaceStr,
+			mdnsDomain,
+			timeout,
+			disableIPv4,
+			disableIPv6,
+			hostPolicy,
+			dnsGatewayAllowCIDRs,
+			dnsGatewayMaxTTL,
+			dnsGatewayRateLimit,
+			dnsGatewayRecords,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid DNS gateway configuration: %v", err)
+		}
+		if dnsGateway && dnsAddr == "" {
+			logrus.Fatal("Invalid DNS gateway configuration: --dns-gateway requires --dns-address")
+		}
+
+		publicServiceType := "_http._tcp"
+		if tlsCertFile != "" {
+			publicServiceType = "_https._tcp"
+		}
+		port := publicPort
+		if port == 0 {
+			_, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				logrus.Fatalf("Invalid address: %v", err)
+			}
+			addrPort, err := net.LookupPort("tcp", portStr)
+			if err != nil {
+				logrus.Fatalf("Invalid address: %v", err)
+			}
+			port = uint16(addrPort)
+		}
+
+		var sdServiceType string
+		if dnsSD {
+			sdServiceType = publicServiceType
+			if dnsAddr == "" {
+				logrus.Fatal("Invalid DNS-SD configuration: --dns-sd requires --dns-address")
+			}
+		}
+
+		dnsServer, err := server.NewDNSServer(
+			dnsAddr,
+			baseDomain,
+			interfaceStr,
+			service,
+			mdnsDomain,
+			timeout,
+			disableIPv4,
+			disableIPv6,
+			hostAliases,
+			hostPolicy,
+			dnsAnswerAddresses,
+			dnsTTL,
+			dnsRefreshInterval,
+			dnsGw,
+			sdServiceType,
+			port,
+		)
+		if err != nil {
+			logrus.Fatalf("Invalid DNS configuration: %v", err)
+		}
+
+		var readvertiser *server.Readvertiser
+		if readvertiseInterface != "" {
+			readvertiser, err = server.NewReadvertiser(
+				readvertiseInterface,
+				interfaceStr,
+				baseDomain,
+				service,
+				mdnsDomain,
+				timeout,
+				disableIPv4,
+				disableIPv6,
+				hostAliases,
+				hostPolicy,
+				publicServiceType,
+				port,
+				readvertiseRefreshInterval,
+			)
+			if err != nil {
+				logrus.Fatalf("Invalid re-advertising configuration: %v", err)
+			}
+		}
+
+		var reflector *server.Reflector
+		if len(reflectInterfaces) > 0 {
+			reflector, err = server.NewReflector(
+				reflectInterfaces,
+				disableIPv4,
+				disableIPv6,
+				reflectAllow,
+				reflectDeny,
+			)
+			if err != nil {
+				logrus.Fatalf("Invalid mDNS reflector configuration: %v", err)
+			}
+		}
+
+		var advertiser *server.Advertiser
+		if advertise {
+			advertiser, err = server.NewAdvertiser(
+				advertiseInterface,
+				disableIPv4,
+				disableIPv6,
+				advertiseName,
+				publicServiceType,
+				port,
+				baseDomain,
+				string(version.GetVersion()),
+				timeout,
+			)
+			if err != nil {
+				logrus.Fatalf("Invalid advertising configuration: %v", err)
+			}
+		}
+
+		adminSrv := server.NewAdminServer(ctx, adminAddr, proxyCache)
+
 		go func() {
 			sig := make(chan os.Signal, 1)
 			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 			<-sig
 
 			logger.Info("Shutting down...")
+			if advertise {
+				advertiser.Close()
+			}
+			tcpForwarder.Close()
+			if sniAddr != "" {
+				sniRouter.Close()
+			}
+			if socksAddr != "" {
+				socksServer.Close()
+			}
+			if dnsAddr != "" {
+				dnsServer.Close()
+			}
+			if readvertiseInterface != "" {
+				readvertiser.Close()
+			}
+			if len(reflectInterfaces) > 0 {
+				reflector.Close()
+			}
+			if adminAddr != "" {
+				if err := adminSrv.Shutdown(ctx); err != nil {
+					logger.Errorf("Admin shutdown request failed: %v", err)
+				}
+			}
 			if err := srv.Shutdown(ctx); err != nil {
 				logger.Errorf("Shutdown request failed: %v", err)
 			}
 		}()
 
+		if adminAddr != "" {
+			go func() {
+				logger.Infof("Starting admin server on %s", adminAddr)
+				if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+					logger.Fatalf("Admin server error: %v", err)
+				}
+			}()
+		}
+
+		if err := tcpForwarder.Listen(); err != nil {
+			logger.Fatalf("TCP forwarding error: %v", err)
+		}
+		go tcpForwarder.Serve(ctx)
+
+		if sniAddr != "" {
+			if err := sniRouter.Listen(); err != nil {
+				logger.Fatalf("TLS routing error: %v", err)
+			}
+			go sniRouter.Serve(ctx)
+		}
+
+		if socksAddr != "" {
+			if err := socksServer.Listen(); err != nil {
+				logger.Fatalf("SOCKS server error: %v", err)
+			}
+			go socksServer.Serve(ctx)
+		}
+
+		if dnsAddr != "" {
+			if err := dnsServer.Listen(); err != nil {
+				logger.Fatalf("DNS server error: %v", err)
+			}
+			go dnsServer.Serve(ctx)
+		}
+
+		if readvertiseInterface != "" {
+			if err := readvertiser.Start(); err != nil {
+				logger.Fatalf("Re-advertising error: %v", err)
+			}
+			go readvertiser.Serve(ctx)
+		}
+
+		if len(reflectInterfaces) > 0 {
+			if err := reflector.Listen(); err != nil {
+				logger.Fatalf("mDNS reflector error: %v", err)
+			}
+			go reflector.Serve(ctx)
+		}
+
+		var listener net.Listener
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			logger.Fatalf("Error listening on %s: %v", addr, err)
+		}
+		if proxyProtocol {
+			listener, err = server.NewProxyProtocolListener(
+				listener,
+				proxyProtocolTrustedCIDRs,
+				proxyProtocolTimeout,
+			)
+			if err != nil {
+				logger.Fatalf("Invalid PROXY protocol configuration: %v", err)
+			}
+		}
+
+		// The proxy is advertised only once it accepts connections
+		if advertise {
+			if err := advertiser.Start(ctx); err != nil {
+				logger.Fatalf("Advertising error: %v", err)
+			}
+		}
+
 		logger.Infof("Starting server on %s", addr)
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if tlsCertFile != "" {
+			err = srv.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
 			logger.Fatalf("Server error: %v", err)
 		}
 		logger.Info("Exiting")
@@ -94,6 +775,11 @@ func init() {
 		"TCP address for the server to listen on.",
 	)
 
+	Cmd.Flags().Uint16VarP(
+		&publicPort, "public-port", "", defaultPublicPort,
+		"Port clients reach the server at, when published with DNS-SD or mDNS (eg: when behind a reverse proxy). Defaults to the port of --address",
+	)
+
 	Cmd.PersistentFlags().StringVarP(
 		&service, "service", "s", defaultService,
 		"Service",
@@ -123,14 +809,498 @@ func init() {
 		&disableIPv6, "disable-ipv6", "", defaultDisableIPv6,
 		"Whether to disable usage of IPv6 for MDNS operations. Does not affect discovered addresses.",
 	)
+
+	Cmd.Flags().StringVarP(
+		&routingMode, "routing-mode", "", defaultRoutingMode,
+		fmt.Sprintf(
+			"How mDNS hosts are accessed: %s (eg: foo.example.com) or %s (eg: example.com/d/foo/, when wildcard DNS is not available)",
+			server.RoutingSubdomain, server.RoutingPath,
+		),
+	)
+
+	Cmd.Flags().StringVarP(
+		&pathPrefix, "path-prefix", "", defaultPathPrefix,
+		"Path prefix for mDNS hosts when using the path routing mode",
+	)
+
+	Cmd.Flags().StringToStringVarP(
+		&aliases, "alias", "", defaultAliases,
+		"Alias to access a mDNS host with, in the format alias=host (eg: garage-door=esp32-a1b2c3.local)",
+	)
+
+	Cmd.Flags().StringToStringVarP(
+		&displayNames, "display-name", "", defaultDisplayNames,
+		"Friendly name to display for a host or alias, in the format host=name",
+	)
+
+	Cmd.Flags().StringToStringVarP(
+		&descriptions, "description", "", defaultDescriptions,
+		"Description to display for a host or alias, in the format host=description",
+	)
+
+	Cmd.Flags().StringVarP(
+		&aliasTxtKey, "alias-txt-key", "", defaultAliasTxtKey,
+		"TXT record key used to derive aliases and display names from (eg: friendly_name)",
+	)
+
+	Cmd.Flags().StringArrayVarP(
+		&allowHosts, "allow-host", "", defaultAllowHosts,
+		"Only allow access to mDNS hosts matching this rule. Rules can be host:<glob> (or just <glob>), service:<type> or txt:<key>[=<glob>]",
+	)
+
+	Cmd.Flags().StringArrayVarP(
+		&denyHosts, "deny-host", "", defaultDenyHosts,
+		"Deny access to mDNS hosts matching this rule. Same format as --allow-host, and takes precedence over it",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&hostPolicyCacheTTL, "host-policy-cache-ttl", "", defaultHostPolicyCacheTTL,
+		"How long to cache browsed services used by service and TXT host rules",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&upstreamAllowCIDRs, "upstream-allow-cidr", "", defaultUpstreamAllowCIDRs,
+		"Only allow upstream connections to addresses within these networks (eg: 192.168.1.0/24)",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&upstreamDenyCIDRs, "upstream-deny-cidr", "", defaultUpstreamDenyCIDRs,
+		"Deny upstream connections to addresses within these networks. Takes precedence over --upstream-allow-cidr",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&upstreamDenyLocalAddresses, "upstream-deny-local-addresses", "", defaultUpstreamDenyLocalAddresses,
+		"Deny upstream connections to addresses assigned to the proxy host itself",
+	)
+
+	Cmd.Flags().StringVarP(
+		&upstreamBindMode, "upstream-bind-mode", "", defaultUpstreamBindMode,
+		fmt.Sprintf(
+			"How to bind upstream connections to an interface: %s, %s (eg: SO_BINDTODEVICE) or %s",
+			server.UpstreamBindNone, server.UpstreamBindDevice, server.UpstreamBindSourceAddress,
+		),
+	)
+
+	Cmd.Flags().StringVarP(
+		&upstreamBindInterface, "upstream-bind-interface", "", defaultUpstreamBindInterface,
+		"Interface to bind upstream connections to. If empty, the interface where the host was discovered is used",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&upstreamDialTimeout, "upstream-dial-timeout", "", defaultUpstreamDialTimeout,
+		"Timeout for connecting to upstream hosts",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&upstreamIdleTimeout, "upstream-idle-timeout", "", defaultUpstreamIdleTimeout,
+		"How long to keep idle upstream connections open for reuse",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&upstreamResponseHeaderTimeout, "upstream-response-header-timeout", "", defaultUpstreamResponseHeaderTimeout,
+		"How long to wait for upstream response headers",
+	)
+
+	Cmd.Flags().IntVarP(
+		&upstreamMaxConnsPerHost, "upstream-max-conns-per-host", "", defaultUpstreamMaxConnsPerHost,
+		"Maximum number of connections to each upstream host (0 for no limit). Many microcontroller based devices only accept a few connections",
+	)
+
+	Cmd.Flags().IntVarP(
+		&upstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", "", defaultUpstreamMaxIdleConnsPerHost,
+		"Maximum number of idle connections kept open to each upstream host",
+	)
+
+	Cmd.Flags().IntVarP(
+		&upstreamMaxRequestsPerHost, "upstream-max-requests-per-host", "", defaultUpstreamMaxRequestsPerHost,
+		"Maximum number of in-flight requests to each upstream host (0 for no limit), including open long-lived streams. Excess requests are queued",
+	)
+
+	Cmd.Flags().IntVarP(
+		&upstreamMaxQueuePerHost, "upstream-max-queue-per-host", "", defaultUpstreamMaxQueuePerHost,
+		"Maximum number of requests queued for each upstream host. Excess requests are refused with 503",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&upstreamQueueTimeout, "upstream-queue-timeout", "", defaultUpstreamQueueTimeout,
+		"Maximum time a request waits in queue for an upstream host before being refused with 503",
+	)
+
+	Cmd.Flags().StringToIntVarP(
+		&upstreamHostMaxRequests, "upstream-host-max-requests", "", defaultUpstreamHostMaxRequests,
+		"Per host override of --upstream-max-requests-per-host, in the format host=limit",
+	)
+
+	Cmd.Flags().StringToIntVarP(
+		&upstreamHostMaxQueue, "upstream-host-max-queue", "", defaultUpstreamHostMaxQueue,
+		"Per host override of --upstream-max-queue-per-host, in the format host=limit",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&rewriteBodyHosts, "rewrite-body", "", defaultRewriteBodyHosts,
+		"mDNS hosts (or * for all) which have absolute URLs referencing mDNS hosts or their IP rewritten in response bodies",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&rewriteBodyContentTypes, "rewrite-body-content-types", "", defaultRewriteBodyContentTypes,
+		"Content types of response bodies to rewrite",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&compress, "compress", "", defaultCompress,
+		"Compress responses, with an encoding negotiated with the client",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&compressEncodings, "compress-encodings", "", defaultCompressEncodings,
+		"Encodings to compress responses with, in order of preference (br, zstd or gzip)",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&compressContentTypes, "compress-content-types", "", defaultCompressContentTypes,
+		"Content types of responses to compress",
+	)
+
+	Cmd.Flags().IntVarP(
+		&compressMinSize, "compress-min-size", "", defaultCompressMinSize,
+		"Minimum size in bytes of responses to compress. Responses of unknown length are only compressed when their first flush reaches it",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&compressDisableHosts, "compress-disable-host", "", defaultCompressDisableHosts,
+		"mDNS host to not compress responses from (eg: foo.local). Can be given multiple times",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&cache, "cache", "", defaultCache,
+		"Cache upstream responses, honoring Cache-Control, ETag and Last-Modified",
+	)
+
+	Cmd.Flags().Int64VarP(
+		&cacheMaxSize, "cache-max-size", "", defaultCacheMaxSize,
+		"Maximum total size in bytes of cached responses, least recently used ones are evicted",
+	)
+
+	Cmd.Flags().Int64VarP(
+		&cacheMaxEntrySize, "cache-max-entry-size", "", defaultCacheMaxEntrySize,
+		"Maximum size in bytes of a cached response",
+	)
+
+	Cmd.Flags().StringVarP(
+		&cacheDir, "cache-dir", "", defaultCacheDir,
+		"Store cached responses in this directory instead of memory",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&cacheRules, "cache-rule", "", defaultCacheRules,
+		"Cache rule in the format host/path=ttl (eg: foo.local/static/**=1h), overriding how long matching responses are cached, 0 to not cache them. Responses specific to a client (private, setting cookies, or for requests with credentials) are never cached. \"*\" matches anything but \"/\", \"**\" matches anything. Can be given multiple times, the first matching rule is used",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&flushInterval, "flush-interval", "", defaultFlushInterval,
+		"How often to flush proxied responses to clients: 0 to only flush when buffers are full, or -1 to flush after every write. Streaming responses and responses of unknown length are always flushed immediately",
+	)
+
+	Cmd.Flags().IntVarP(
+		&streamMaxPerClient, "stream-max-per-client", "", defaultStreamMaxPerClient,
+		"Maximum number of concurrent long-lived streams (WebSockets, Server-Sent Events) per client, 0 for no limit",
+	)
+
+	Cmd.Flags().IntVarP(
+		&streamMaxPerHost, "stream-max-per-host", "", defaultStreamMaxPerHost,
+		"Maximum number of concurrent long-lived streams (WebSockets, Server-Sent Events) per mDNS host, 0 for no limit",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&streamIdleTimeout, "stream-idle-timeout", "", defaultStreamIdleTimeout,
+		"Close long-lived streams without traffic for this long, 0 to disable",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&streamMaxLifetime, "stream-max-lifetime", "", defaultStreamMaxLifetime,
+		"Close long-lived streams open for this long, 0 to disable",
+	)
+
+	Cmd.Flags().StringVarP(
+		&tlsCertFile, "tls-cert", "", defaultTLSCertFile,
+		"Certificate file to serve HTTPS (with HTTP/2) with, must be used with --tls-key",
+	)
+
+	Cmd.Flags().StringVarP(
+		&tlsKeyFile, "tls-key", "", defaultTLSKeyFile,
+		"Private key file to serve HTTPS (with HTTP/2) with, must be used with --tls-cert",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&h2c, "h2c", "", defaultH2C,
+		"Enable cleartext HTTP/2 (h2c), eg: for a reverse proxy in front of this server speaking h2c",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&tcpForwards, "tcp-forward", "", defaultTCPForwards,
+		"Forward TCP connections in the format listen_address=target, where target is either host:<host>:<port> (eg: :2222=host:foo.local:22), service:<type> (eg: :1883=service:_mqtt._tcp) or instance:<type>/<name>. Can be given multiple times",
+	)
+
+	Cmd.Flags().IntVarP(
+		&tunnelMaxPerClient, "tunnel-max-per-client", "", defaultTunnelMaxPerClient,
+		"Maximum number of concurrent tunneled connections per client, for each of TCP forwarding, TLS routing, CONNECT and SOCKS, 0 for no limit",
+	)
+
+	Cmd.Flags().IntVarP(
+		&tunnelMaxPerHost, "tunnel-max-per-host", "", defaultTunnelMaxPerHost,
+		"Maximum number of concurrent tunneled connections per mDNS host, for each of TCP forwarding, TLS routing, CONNECT and SOCKS, 0 for no limit",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&tunnelIdleTimeout, "tunnel-idle-timeout", "", defaultTunnelIdleTimeout,
+		"Close tunneled connections (TCP forwarding, TLS routing, CONNECT and SOCKS) without traffic for this long, 0 to disable",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&forwardProxy, "forward-proxy", "", defaultForwardProxy,
+		"Also act as a standard HTTP proxy (absolute-URI requests and CONNECT) for mDNS hosts only. A proxy auto-config file is served at /proxy.pac on the base domain",
+	)
+
+	Cmd.Flags().StringVarP(
+		&socksAddr, "socks-address", "", defaultSOCKSAddr,
+		"TCP address for a SOCKS5 server to listen on, which only allows connections to mDNS hosts by name. Disabled if empty",
+	)
+
+	Cmd.Flags().StringToStringVarP(
+		&socksUsers, "socks-user", "", defaultSOCKSUsers,
+		"SOCKS user in the format user=password. Can be given multiple times",
+	)
+
+	Cmd.Flags().StringVarP(
+		&socksUsersFile, "socks-users-file", "", defaultSOCKSUsersFile,
+		"File with SOCKS users, one user:password per line",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&socksNoAuth, "socks-no-auth", "", defaultSOCKSNoAuth,
+		"Allow SOCKS clients without authentication when no users are set. This exposes all mDNS hosts to anyone who can reach the SOCKS server",
+	)
+
+	Cmd.Flags().StringVarP(
+		&sniAddr, "sni-address", "", defaultSNIAddr,
+		"TCP address to listen on for TLS connections, which are routed to mDNS hosts by server name (${mdns_host}.${base_domain}) without terminating TLS. Disabled if empty",
+	)
+
+	Cmd.Flags().Uint16VarP(
+		&sniUpstreamPort, "sni-upstream-port", "", defaultSNIUpstreamPort,
+		"Port of mDNS hosts to route TLS connections to",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&sniHelloTimeout, "sni-hello-timeout", "", defaultSNIHelloTimeout,
+		"How long to wait for the TLS ClientHello of routed TLS connections",
+	)
+
+	Cmd.Flags().StringVarP(
+		&dnsAddr, "dns-address", "", defaultDNSAddr,
+		"Address for a DNS server (UDP and TCP) to listen on, which answers queries for the base domain and its discovered hosts with the proxy addresses. Disabled if empty",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&dnsAnswerAddresses, "dns-answer-addresses", "", defaultDNSAnswerAddresses,
+		"Addresses to answer DNS queries for the base domain with. By default, the address queries are received at, or when listening on all addresses, the global unicast addresses of all interfaces",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&dnsTTL, "dns-ttl", "", defaultDNSTTL,
+		"TTL of DNS answers for the base domain",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&dnsRefreshInterval, "dns-refresh-interval", "", defaultDNSRefreshInterval,
+		"How often to refresh the discovered hosts answered by the DNS server",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&dnsSD, "dns-sd", "", defaultDNSSD,
+		"Publish discovered services with DNS-SD under the base domain at the DNS server, as _http._tcp (or _https._tcp with TLS) services pointing to the proxy",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&dnsGateway, "dns-gateway", "", defaultDNSGateway,
+		"Also answer unicast queries for mDNS names (eg: foo.local) at the DNS server, for clients which can not use mDNS",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&dnsGatewayAllowCIDRs, "dns-gateway-allow-cidr", "", defaultDNSGatewayAllowCIDRs,
+		"Client networks allowed to query mDNS names at the DNS server",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&dnsGatewayMaxTTL, "dns-gateway-max-ttl", "", defaultDNSGatewayMaxTTL,
+		"Maximum TTL of DNS answers for mDNS names",
+	)
+
+	Cmd.Flags().Float64VarP(
+		&dnsGatewayRateLimit, "dns-gateway-rate-limit", "", defaultDNSGatewayRateLimit,
+		"Maximum DNS responses per second for mDNS names to each client, 0 for no limit",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&dnsGatewayRecords, "dns-gateway-records", "", defaultDNSGatewayRecords,
+		fmt.Sprintf(
+			"Record types to answer for mDNS names besides A and AAAA: %s, %s and/or %s (DNS-SD)",
+			server.DNSGatewayRecordPTR, server.DNSGatewayRecordSRV, server.DNSGatewayRecordTXT,
+		),
+	)
+
+	Cmd.Flags().StringVarP(
+		&readvertiseInterface, "readvertise-interface", "", defaultReadvertiseInterface,
+		"Client facing interface to publish discovered hosts at with mDNS, as ${alias}.${base_domain} with the addresses of the interface, along with services pointing to the proxy. Disabled if empty",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&readvertiseRefreshInterval, "readvertise-refresh-interval", "", defaultReadvertiseRefreshInterval,
+		"How often to refresh re-advertised hosts",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&reflectInterfaces, "reflect-interface", "", defaultReflectInterfaces,
+		"Interfaces to relay mDNS queries and responses between, filtered by --reflect-allow and --reflect-deny. Disabled if empty",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&reflectAllow, "reflect-allow", "", defaultReflectAllow,
+		"Only reflect mDNS questions and records matching this rule (of the same kind). Rules are in the format [<from>><to>:]<host|service>:<glob> (eg: eth0>eth1:service:_http._tcp). Service rules do not restrict host records (addresses and reverse lookups), which need host rules",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&reflectDeny, "reflect-deny", "", defaultReflectDeny,
+		"Never reflect mDNS questions and records matching this rule. Same format as --reflect-allow, and takes precedence over it",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&advertise, "advertise", "", defaultAdvertise,
+		"Advertise the proxy itself with mDNS as a _http._tcp (or _https._tcp with TLS) service, with TXT keys for the base domain and version",
+	)
+
+	Cmd.Flags().StringVarP(
+		&advertiseName, "advertise-name", "", defaultAdvertiseName,
+		"Service name to advertise the proxy with",
+	)
+
+	Cmd.Flags().StringVarP(
+		&advertiseInterface, "advertise-interface", "", defaultAdvertiseInterface,
+		"Interface to advertise the proxy at",
+	)
+
+	Cmd.Flags().StringVarP(
+		&adminAddr, "admin-address", "", defaultAdminAddr,
+		"TCP address for the admin server (metrics at /debug/vars, cache purge at /cache/purge) to listen on. Disabled if empty",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&trustedProxies, "trusted-proxies", "", defaultTrustedProxies,
+		"Networks of proxies trusted to set Forwarded, X-Forwarded-* and X-Real-IP headers (eg: 127.0.0.1/32)",
+	)
+
+	Cmd.Flags().BoolVarP(
+		&proxyProtocol, "proxy-protocol", "", defaultProxyProtocol,
+		"Parse PROXY protocol v1 and v2 headers from connections of peers within --proxy-protocol-trusted",
+	)
+
+	Cmd.Flags().StringSliceVarP(
+		&proxyProtocolTrustedCIDRs, "proxy-protocol-trusted", "", defaultProxyProtocolTrustedCIDRs,
+		"Networks of load balancers trusted to send PROXY protocol headers (eg: 10.0.0.1/32). Connections from them without a header are refused",
+	)
+
+	Cmd.Flags().DurationVarP(
+		&proxyProtocolTimeout, "proxy-protocol-timeout", "", defaultProxyProtocolTimeout,
+		"Timeout for reading the PROXY protocol header",
+	)
 }
 
 func Reset() {
 	addr = defaultAddr
+	publicPort = defaultPublicPort
 	service = defaultService
 	mdnsDomain = defaultMdnsDomain
 	timeout = defaultTimeout
 	interfaceStr = defaultIntterfaceStr
 	disableIPv4 = defaultDisableIPv4
 	disableIPv6 = defaultDisableIPv6
+	routingMode = defaultRoutingMode
+	pathPrefix = defaultPathPrefix
+	aliases = defaultAliases
+	displayNames = defaultDisplayNames
+	descriptions = defaultDescriptions
+	aliasTxtKey = defaultAliasTxtKey
+	allowHosts = defaultAllowHosts
+	denyHosts = defaultDenyHosts
+	hostPolicyCacheTTL = defaultHostPolicyCacheTTL
+	upstreamAllowCIDRs = defaultUpstreamAllowCIDRs
+	upstreamDenyCIDRs = defaultUpstreamDenyCIDRs
+	upstreamDenyLocalAddresses = defaultUpstreamDenyLocalAddresses
+	upstreamBindMode = defaultUpstreamBindMode
+	upstreamBindInterface = defaultUpstreamBindInterface
+	upstreamDialTimeout = defaultUpstreamDialTimeout
+	upstreamIdleTimeout = defaultUpstreamIdleTimeout
+	upstreamResponseHeaderTimeout = defaultUpstreamResponseHeaderTimeout
+	upstreamMaxConnsPerHost = defaultUpstreamMaxConnsPerHost
+	upstreamMaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	upstreamMaxRequestsPerHost = defaultUpstreamMaxRequestsPerHost
+	upstreamMaxQueuePerHost = defaultUpstreamMaxQueuePerHost
+	upstreamQueueTimeout = defaultUpstreamQueueTimeout
+	upstreamHostMaxRequests = defaultUpstreamHostMaxRequests
+	upstreamHostMaxQueue = defaultUpstreamHostMaxQueue
+	rewriteBodyHosts = defaultRewriteBodyHosts
+	rewriteBodyContentTypes = defaultRewriteBodyContentTypes
+	compress = defaultCompress
+	compressEncodings = defaultCompressEncodings
+	compressContentTypes = defaultCompressContentTypes
+	compressMinSize = defaultCompressMinSize
+	compressDisableHosts = defaultCompressDisableHosts
+	cache = defaultCache
+	cacheMaxSize = defaultCacheMaxSize
+	cacheMaxEntrySize = defaultCacheMaxEntrySize
+	cacheDir = defaultCacheDir
+	cacheRules = defaultCacheRules
+	flushInterval = defaultFlushInterval
+	streamMaxPerClient = defaultStreamMaxPerClient
+	streamMaxPerHost = defaultStreamMaxPerHost
+	streamIdleTimeout = defaultStreamIdleTimeout
+	streamMaxLifetime = defaultStreamMaxLifetime
+	tcpForwards = defaultTCPForwards
+	tunnelMaxPerClient = defaultTunnelMaxPerClient
+	tunnelMaxPerHost = defaultTunnelMaxPerHost
+	tunnelIdleTimeout = defaultTunnelIdleTimeout
+	forwardProxy = defaultForwardProxy
+	socksAddr = defaultSOCKSAddr
+	socksUsers = defaultSOCKSUsers
+	socksUsersFile = defaultSOCKSUsersFile
+	socksNoAuth = defaultSOCKSNoAuth
+	sniAddr = defaultSNIAddr
+	sniUpstreamPort = defaultSNIUpstreamPort
+	sniHelloTimeout = defaultSNIHelloTimeout
+	dnsAddr = defaultDNSAddr
+	dnsAnswerAddresses = defaultDNSAnswerAddresses
+	dnsTTL = defaultDNSTTL
+	dnsRefreshInterval = defaultDNSRefreshInterval
+	dnsSD = defaultDNSSD
+	dnsGateway = defaultDNSGateway
+	dnsGatewayAllowCIDRs = defaultDNSGatewayAllowCIDRs
+	dnsGatewayMaxTTL = defaultDNSGatewayMaxTTL
+	dnsGatewayRateLimit = defaultDNSGatewayRateLimit
+	dnsGatewayRecords = defaultDNSGatewayRecords
+	readvertiseInterface = defaultReadvertiseInterface
+	readvertiseRefreshInterval = defaultReadvertiseRefreshInterval
+	reflectInterfaces = defaultReflectInterfaces
+	reflectAllow = defaultReflectAllow
+	reflectDeny = defaultReflectDeny
+	advertise = defaultAdvertise
+	advertiseName = defaultAdvertiseName
+	advertiseInterface = defaultAdvertiseInterface
+	adminAddr = defaultAdminAddr
+	trustedProxies = defaultTrustedProxies
+	proxyProtocol = defaultProxyProtocol
+	proxyProtocolTrustedCIDRs = defaultProxyProtocolTrustedCIDRs
+	proxyProtocolTimeout = defaultProxyProtocolTimeout
+	tlsCertFile = defaultTLSCertFile
+	tlsKeyFile = defaultTLSKeyFile
+	h2c = defaultH2C
 }
@@ -3,6 +3,7 @@ module github.com/fornellas/mdns-proxy
 go 1.23.2
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/client9/misspell v0.3.4
 	github.com/fatih/color v1.17.0
 	github.com/fornellas/rrb v0.1.1
@@ -10,10 +11,14 @@ require (
 	github.com/godbus/dbus/v5 v5.1.0
 	github.com/holoplot/go-avahi v1.0.1
 	github.com/jandelgado/gcov2lcov v1.0.6
+	github.com/klauspost/compress v1.17.11
+	github.com/miekg/dns v1.1.62
 	github.com/openconfig/goyang v1.6.0
 	github.com/rakyll/gotest v0.0.6
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v1.8.1
+	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.26.0
 	golang.org/x/tools v0.26.0
 	golang.org/x/vuln v1.1.3
 	honnef.co/go/tools v0.5.1
@@ -34,6 +39,6 @@ require (
 	golang.org/x/exp/typeparams v0.0.0-20231108232855-2478ac86f678 // indirect
 	golang.org/x/mod v0.21.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/sys v0.26.0 // indirect
 	golang.org/x/telemetry v0.0.0-20240522233618-39ace7a40ae7 // indirect
+	golang.org/x/text v0.19.0 // indirect
 )
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -22,6 +24,49 @@ type Service struct {
 	Host      string
 	IP        net.IP
 	Port      uint16
+	Txt       map[string]string
+}
+
+func parseTxt(txt [][]byte) map[string]string {
+	txtMap := map[string]string{}
+	for _, entry := range txt {
+		key, value, _ := strings.Cut(string(entry), "=")
+		key = strings.ToLower(key)
+		if key == "" {
+			continue
+		}
+		if _, ok := txtMap[key]; ok {
+			continue
+		}
+		txtMap[key] = value
+	}
+	return txtMap
+}
+
+type Host struct {
+	Interface string
+	Protocol  Proto
+	Name      string
+	IP        net.IP
+}
+
+// Zone returns the IPv6 zone required to reach the host, which is set only for link-local
+// addresses.
+func (h Host) Zone() string {
+	if h.IP.To4() == nil && h.IP.IsLinkLocalUnicast() {
+		return h.Interface
+	}
+	return ""
+}
+
+// HostPort returns a "host:port" address for the given port, which includes the IPv6 zone
+// when required.
+func (h Host) HostPort(port uint16) string {
+	ip := h.IP.String()
+	if zone := h.Zone(); zone != "" {
+		ip = fmt.Sprintf("%s%%%s", ip, zone)
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port)))
 }
 
 func newServiceFromAvahi(service avahi.Service) (Service, error) {
@@ -44,6 +89,7 @@ func newServiceFromAvahi(service avahi.Service) (Service, error) {
 		Host:      service.Host,
 		IP:        ip,
 		Port:      service.Port,
+		Txt:       parseTxt(service.Txt),
 	}, nil
 }
 
@@ -191,22 +237,22 @@ func (m *MDNS) ResolveHost(
 	host string,
 	ifaceName string,
 	proto Proto,
-) (net.IP, error) {
+) (Host, error) {
 	var iface int32
 	iface, err := getIfaceIdxFromName(ifaceName)
 	if err != nil {
-		return nil, err
+		return Host{}, err
 	}
 
 	dbusConn, err := dbus.SystemBus()
 	if err != nil {
-		return nil, err
+		return Host{}, err
 	}
 	defer func() { dbusConn.Close() }()
 
 	avahiServer, err := avahi.ServerNew(dbusConn)
 	if err != nil {
-		return nil, err
+		return Host{}, err
 	}
 	defer func() { avahiServer.Close() }()
 
@@ -218,13 +264,23 @@ func (m *MDNS) ResolveHost(
 		0,
 	)
 	if err != nil {
-		return nil, err
+		return Host{}, err
 	}
 
 	ip := net.ParseIP(hostName.Address)
 	if ip == nil {
-		return nil, fmt.Errorf("invalid IP: %v", hostName.Address)
+		return Host{}, fmt.Errorf("invalid IP: %v", hostName.Address)
+	}
+
+	netIface, err := net.InterfaceByIndex(int(hostName.Interface))
+	if err != nil {
+		return Host{}, err
 	}
 
-	return ip, nil
+	return Host{
+		Interface: netIface.Name,
+		Protocol:  Proto(hostName.Protocol),
+		Name:      hostName.Name,
+		IP:        ip,
+	}, nil
 }
@@ -0,0 +1,197 @@
+package mdns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/holoplot/go-avahi"
+)
+
+// ErrCollision is returned when published records conflict with records of other hosts.
+var ErrCollision = errors.New("name collision")
+
+// PublishedService is a service to be published.
+type PublishedService struct {
+	Name string
+	Type string
+	Port uint16
+	Txt  map[string]string
+}
+
+func (s PublishedService) txt() [][]byte {
+	txt := []string{}
+	for key, value := range s.Txt {
+		txt = append(txt, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(txt)
+	txtBytes := [][]byte{}
+	for _, entry := range txt {
+		txtBytes = append(txtBytes, []byte(entry))
+	}
+	return txtBytes
+}
+
+// Publisher publishes records with mDNS, through Avahi entry groups.
+type Publisher struct {
+	dbusConn    *dbus.Conn
+	avahiServer *avahi.Server
+}
+
+// NewPublisher connects to Avahi. Close must be called to withdraw all published records.
+func NewPublisher() (*Publisher, error) {
+	// Avahi withdraws the records of a client when it disconnects, so a private connection
+	// is used, as the shared one is closed after each browse or resolve
+	dbusConn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	avahiServer, err := avahi.ServerNew(dbusConn)
+	if err != nil {
+		dbusConn.Close()
+		return nil, err
+	}
+	return &Publisher{
+		dbusConn:    dbusConn,
+		avahiServer: avahiServer,
+	}, nil
+}
+
+// Close withdraws all published records, and disconnects from Avahi.
+func (p *Publisher) Close() error {
+	p.avahiServer.Close()
+	return p.dbusConn.Close()
+}
+
+// AlternativeServiceName returns an alternative for a service name which had a collision
+// (eg: "Foo #2" for "Foo").
+func (p *Publisher) AlternativeServiceName(name string) (string, error) {
+	return p.avahiServer.GetAlternativeServiceName(name)
+}
+
+// Group is a set of records published together. When any of them has a collision, all of
+// them are withdrawn.
+type Group struct {
+	publisher  *Publisher
+	entryGroup *avahi.EntryGroup
+
+	mutex sync.Mutex
+	state int32
+	err   string
+
+	stateChanged chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func (g *Group) watch() {
+	for {
+		select {
+		case state := <-g.entryGroup.StateChangeChannel:
+			g.mutex.Lock()
+			g.state = state.State
+			g.err = state.Error
+			g.mutex.Unlock()
+			select {
+			case g.stateChanged <- struct{}{}:
+			default:
+			}
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// Err returns ErrCollision when the records of the group had a collision, or an error
+// when publishing failed. Both cases withdraw the records.
+func (g *Group) Err() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	switch g.state {
+	case avahi.EntryGroupCollision:
+		return ErrCollision
+	case avahi.EntryGroupFailure:
+		return fmt.Errorf("failed publishing: %s", g.err)
+	}
+	return nil
+}
+
+// Close withdraws the records of the group. It can be called more than once.
+func (g *Group) Close() {
+	g.closeOnce.Do(func() {
+		g.publisher.avahiServer.EntryGroupFree(g.entryGroup)
+		close(g.done)
+	})
+}
+
+// Publish publishes a group with records for host (eg: foo.local) with the given addresses,
+// and the given services, which point to host, at the given interface. It waits up to
+// timeout for the records to be established.
+func (p *Publisher) Publish(
+	ifaceName string,
+	proto Proto,
+	host string,
+	ips []net.IP,
+	services []PublishedService,
+	timeout time.Duration,
+) (*Group, error) {
+	iface, err := getIfaceIdxFromName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	entryGroup, err := p.avahiServer.EntryGroupNew()
+	if err != nil {
+		return nil, err
+	}
+	g := &Group{
+		publisher:    p,
+		entryGroup:   entryGroup,
+		stateChanged: make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+	go g.watch()
+
+	for _, ip := range ips {
+		// Reverse records would conflict with the records of this host
+		if err := entryGroup.AddAddress(iface, int32(proto), avahi.PublishNoReverse, host, ip.String()); err != nil {
+			g.Close()
+			return nil, fmt.Errorf("error adding address %s for %s: %w", ip, host, err)
+		}
+	}
+	for _, service := range services {
+		if err := entryGroup.AddService(
+			iface, int32(proto), 0, service.Name, service.Type, "", host, service.Port, service.txt(),
+		); err != nil {
+			g.Close()
+			return nil, fmt.Errorf("error adding service '%s' of type %s: %w", service.Name, service.Type, err)
+		}
+	}
+	if err := entryGroup.Commit(); err != nil {
+		g.Close()
+		return nil, err
+	}
+
+	timeoutCh := time.After(timeout)
+	for {
+		g.mutex.Lock()
+		state := g.state
+		g.mutex.Unlock()
+		if state == avahi.EntryGroupEstablished {
+			return g, nil
+		}
+		if err := g.Err(); err != nil {
+			g.Close()
+			return nil, err
+		}
+		select {
+		case <-g.stateChanged:
+		case <-timeoutCh:
+			g.Close()
+			return nil, fmt.Errorf("timeout publishing %s", host)
+		}
+	}
+}
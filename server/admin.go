@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+)
+
+// NewAdminServer creates a server for administrative endpoints, which should not be
+// exposed to clients:
+//   - /debug/vars: metrics, in expvar format.
+//   - /cache/purge: purges cached responses (POST), optionally only for the given host
+//     and path prefix (eg: /cache/purge?host=foo.local&path=/static/).
+func NewAdminServer(
+	ctx context.Context,
+	addr string,
+	cache *Cache,
+) http.Server {
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/debug/vars", expvar.Handler())
+	serveMux.HandleFunc("/cache/purge", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		purged := cache.Purge(query.Get("host"), query.Get("path"))
+		log.GetLogger(ctx).WithFields(logrus.Fields{
+			"host": query.Get("host"),
+			"path": query.Get("path"),
+		}).Infof("Purged %d cached responses", purged)
+		fmt.Fprintf(w, "Purged %d cached responses\n", purged)
+	})
+
+	return http.Server{
+		Addr:    addr,
+		Handler: serveMux,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// AdvertiseTxtKey is the TXT key of services advertised by Advertiser, set to the proxy
+// version. Services with it are not proxied.
+var AdvertiseTxtKey = "mdns_proxy"
+
+// Advertiser advertises the proxy itself with mDNS, so it can be discovered by clients.
+type Advertiser struct {
+	ifaceName string
+	proto     mdns.Proto
+	service   mdns.PublishedService
+	timeout   time.Duration
+
+	publisher *mdns.Publisher
+	group     *mdns.Group
+}
+
+// NewAdvertiser creates a new Advertiser, which publishes the proxy as service name of
+// serviceType (eg: _http._tcp) at port, with TXT keys for the base domain and version.
+func NewAdvertiser(
+	ifaceName string,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	name string,
+	serviceType string,
+	port uint16,
+	baseDomain string,
+	version string,
+	timeout time.Duration,
+) (*Advertiser, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name must not be empty")
+	}
+	return &Advertiser{
+		ifaceName: ifaceName,
+		proto:     getProto(disableIPv4, disableIPv6),
+		service: mdns.PublishedService{
+			Name: name,
+			Type: serviceType,
+			Port: port,
+			Txt: map[string]string{
+				"path":          "/",
+				"base_domain":   baseDomain,
+				AdvertiseTxtKey: version,
+			},
+		},
+		timeout: timeout,
+	}, nil
+}
+
+// Start publishes the service, renaming it on collisions.
+func (a *Advertiser) Start(ctx context.Context) error {
+	logger := log.GetLogger(ctx)
+	publisher, err := mdns.NewPublisher()
+	if err != nil {
+		return fmt.Errorf("error connecting to Avahi: %w", err)
+	}
+	service := a.service
+	for i := 0; i <= readvertiseMaxRenames; i++ {
+		a.group, err = publisher.Publish(
+			a.ifaceName, a.proto, "", nil, []mdns.PublishedService{service}, a.timeout,
+		)
+		if !errors.Is(err, mdns.ErrCollision) {
+			break
+		}
+		name, err := publisher.AlternativeServiceName(service.Name)
+		if err != nil {
+			publisher.Close()
+			return err
+		}
+		logger.Warnf("Service name '%s' is taken, renaming to '%s'", service.Name, name)
+		service.Name = name
+	}
+	if err != nil {
+		publisher.Close()
+		return fmt.Errorf("error advertising '%s': %w", service.Name, err)
+	}
+	a.publisher = publisher
+	logger.Infof("Advertising '%s' (%s port %d)", service.Name, service.Type, service.Port)
+	return nil
+}
+
+// Close withdraws the service.
+func (a *Advertiser) Close() {
+	if a.publisher == nil {
+		return
+	}
+	a.group.Close()
+	a.publisher.Close()
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// HostAliases maps user facing names to mDNS hosts. All hosts are referenced by their
+// name without the mDNS domain (eg: "esp32-a1b2c3" for "esp32-a1b2c3.local").
+type HostAliases struct {
+	mdnsDomain   string
+	aliases      map[string]string
+	hostAliases  map[string]string
+	displayNames map[string]string
+	descriptions map[string]string
+	txtKey       string
+
+	mutex        sync.Mutex
+	txtAliases   map[string]string
+	txtHostNames map[string]string
+	knownHosts   map[string]bool
+}
+
+// toLabel converts an arbitrary string into a valid DNS label.
+func toLabel(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		if !dash && b.Len() > 0 {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	label := strings.TrimSuffix(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimSuffix(label[:63], "-")
+	}
+	return label
+}
+
+func isLabel(name string) bool {
+	return name != "" && toLabel(name) == strings.ToLower(name)
+}
+
+// NewHostAliases creates a new HostAliases. aliases maps an alias to a mDNS host,
+// while displayNames and descriptions are keyed by either mDNS host or alias. When
+// txtKey is not empty, aliases and display names are also derived from the value
+// of this TXT key of discovered services.
+func NewHostAliases(
+	mdnsDomain string,
+	aliases map[string]string,
+	displayNames map[string]string,
+	descriptions map[string]string,
+	txtKey string,
+) (*HostAliases, error) {
+	h := &HostAliases{
+		mdnsDomain:   mdnsDomain,
+		aliases:      map[string]string{},
+		hostAliases:  map[string]string{},
+		displayNames: map[string]string{},
+		descriptions: map[string]string{},
+		txtKey:       strings.ToLower(txtKey),
+		txtAliases:   map[string]string{},
+		txtHostNames: map[string]string{},
+		knownHosts:   map[string]bool{},
+	}
+
+	for alias, host := range aliases {
+		alias = strings.ToLower(alias)
+		if !isLabel(alias) {
+			return nil, fmt.Errorf("invalid alias %#v: must be a valid DNS label", alias)
+		}
+		host = h.trimMdnsDomain(host)
+		if !isLabel(host) {
+			return nil, fmt.Errorf("invalid host %#v for alias %#v", host, alias)
+		}
+		if otherAlias, ok := h.hostAliases[host]; ok {
+			return nil, fmt.Errorf("host %#v has multiple aliases: %#v, %#v", host, otherAlias, alias)
+		}
+		h.aliases[alias] = host
+		h.hostAliases[host] = alias
+	}
+
+	for name, displayName := range displayNames {
+		h.displayNames[h.resolveStatic(name)] = displayName
+	}
+
+	for name, description := range descriptions {
+		h.descriptions[h.resolveStatic(name)] = description
+	}
+
+	return h, nil
+}
+
+func (h *HostAliases) trimMdnsDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), fmt.Sprintf(".%s", h.mdnsDomain))
+}
+
+func (h *HostAliases) resolveStatic(name string) string {
+	name = h.trimMdnsDomain(name)
+	if host, ok := h.aliases[name]; ok {
+		return host
+	}
+	return name
+}
+
+// HasTxtKey returns whether aliases are derived from TXT records.
+func (h *HostAliases) HasTxtKey() bool {
+	return h.txtKey != ""
+}
+
+// Learn updates TXT derived aliases and display names from the given services.
+// Static aliases and discovered host names always take precedence over TXT derived ones.
+func (h *HostAliases) Learn(services []mdns.Service) {
+	txtAliases := map[string]string{}
+	txtHostNames := map[string]string{}
+	knownHosts := map[string]bool{}
+	for _, service := range services {
+		knownHosts[h.trimMdnsDomain(service.Host)] = true
+	}
+	for _, service := range services {
+		host := h.trimMdnsDomain(service.Host)
+		if h.txtKey == "" {
+			continue
+		}
+		value, ok := service.Txt[h.txtKey]
+		if !ok || value == "" {
+			continue
+		}
+		if _, ok := txtHostNames[host]; ok {
+			continue
+		}
+		txtHostNames[host] = value
+		if _, ok := h.hostAliases[host]; ok {
+			continue
+		}
+		alias := toLabel(value)
+		if alias == "" || alias == host {
+			continue
+		}
+		// Any host can advertise any TXT value, so aliases must not take over names of
+		// other hosts
+		if _, ok := h.aliases[alias]; ok || knownHosts[alias] {
+			continue
+		}
+		if _, ok := h.hostAliases[alias]; ok {
+			continue
+		}
+		if otherHost, ok := txtAliases[alias]; ok && otherHost != host {
+			continue
+		}
+		txtAliases[alias] = host
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.txtAliases = txtAliases
+	h.txtHostNames = txtHostNames
+	h.knownHosts = knownHosts
+}
+
+// Lookup returns the mDNS host for the given name, which may be either an alias or
+// a host name. known reports whether the name is a configured alias, a TXT derived
+// alias or a host seen at the last Learn call.
+func (h *HostAliases) Lookup(name string) (host string, known bool) {
+	name = strings.ToLower(name)
+	if host, ok := h.aliases[name]; ok {
+		return host, true
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.knownHosts[name] {
+		return name, true
+	}
+	if host, ok := h.txtAliases[name]; ok {
+		return host, true
+	}
+	return name, false
+}
+
+// Alias returns the name which should be used to access the given host.
+func (h *HostAliases) Alias(host string) string {
+	host = h.trimMdnsDomain(host)
+	if alias, ok := h.hostAliases[host]; ok {
+		return alias
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for alias, aliasHost := range h.txtAliases {
+		if aliasHost == host {
+			return alias
+		}
+	}
+	return host
+}
+
+// DisplayName returns a friendly name for the given host.
+func (h *HostAliases) DisplayName(host string) string {
+	host = h.trimMdnsDomain(host)
+	if displayName, ok := h.displayNames[host]; ok {
+		return displayName
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if displayName, ok := h.txtHostNames[host]; ok {
+		return displayName
+	}
+	return fmt.Sprintf("%s.%s", host, h.mdnsDomain)
+}
+
+// Description returns the description for the given host, if any.
+func (h *HostAliases) Description(host string) string {
+	return h.descriptions[h.trimMdnsDomain(host)]
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+func TestHostAliasesLookup(t *testing.T) {
+	hostAliases, err := NewHostAliases(
+		"local",
+		map[string]string{"printer": "brother-1234.local"},
+		nil,
+		nil,
+		"friendly_name",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostAliases.Learn([]mdns.Service{
+		{Host: "camera.local"},
+		{Host: "esp32-a1b2c3.local", Txt: map[string]string{"friendly_name": "Living Room"}},
+		// TXT aliases taking over other names
+		{Host: "rogue-1.local", Txt: map[string]string{"friendly_name": "camera"}},
+		{Host: "rogue-2.local", Txt: map[string]string{"friendly_name": "printer"}},
+		{Host: "rogue-3.local", Txt: map[string]string{"friendly_name": "brother-1234"}},
+		// Colliding TXT aliases of different hosts: the first one wins
+		{Host: "lamp-1.local", Txt: map[string]string{"friendly_name": "Lamp"}},
+		{Host: "lamp-2.local", Txt: map[string]string{"friendly_name": "lamp"}},
+	})
+
+	for _, tc := range []struct {
+		name  string
+		host  string
+		known bool
+	}{
+		{name: "living-room", host: "esp32-a1b2c3", known: true},
+		{name: "esp32-a1b2c3", host: "esp32-a1b2c3", known: true},
+		{name: "Camera", host: "camera", known: true},
+		{name: "printer", host: "brother-1234", known: true},
+		{name: "brother-1234", host: "brother-1234"},
+		{name: "lamp", host: "lamp-1", known: true},
+		{name: "unknown", host: "unknown"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, known := hostAliases.Lookup(tc.name)
+			if host != tc.host || known != tc.known {
+				t.Fatalf("expected %#v (known %v), got %#v (known %v)", tc.host, tc.known, host, known)
+			}
+		})
+	}
+
+	for host, alias := range map[string]string{
+		"esp32-a1b2c3.local": "living-room",
+		"rogue-1.local":      "rogue-1",
+		"rogue-2.local":      "rogue-2",
+		"rogue-3.local":      "rogue-3",
+		"brother-1234.local": "printer",
+	} {
+		if got := hostAliases.Alias(host); got != alias {
+			t.Fatalf("expected alias %#v for %s, got %#v", alias, host, got)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultBodyRewriteContentTypes are the content types which have their bodies rewritten
+// by default.
+var DefaultBodyRewriteContentTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/x-javascript",
+	"application/xhtml+xml",
+	"text/css",
+	"text/html",
+	"text/javascript",
+}
+
+// bodyRewriteMaxBuffer is the maximum size of bodies which are fully buffered, so their
+// Content-Length can be set. Larger bodies are streamed.
+var bodyRewriteMaxBuffer = int64(1024 * 1024)
+
+// bodyRewriteHoldback is the number of bytes held back when streaming, so URLs split
+// across reads are still matched.
+var bodyRewriteHoldback = 512
+
+var bodyURLRegexp = regexp.MustCompile(`(?i)((?:https?|wss?):)?//([a-z0-9\-.]+|\[[0-9a-f:.%]+\])(:[0-9]{1,5})?`)
+
+// BodyRewriter rewrites absolute URLs referencing mDNS hosts or upstream IPs in text
+// response bodies (eg: HTML, JavaScript and CSS), so they point to the proxy instead.
+type BodyRewriter struct {
+	mdnsDomain   string
+	allHosts     bool
+	hosts        map[string]bool
+	contentTypes map[string]bool
+}
+
+// NewBodyRewriter creates a new BodyRewriter, enabled for the given mDNS hosts ("*" for
+// all hosts), for responses of the given content types.
+func NewBodyRewriter(
+	mdnsDomain string,
+	hosts []string,
+	contentTypes []string,
+) *BodyRewriter {
+	b := &BodyRewriter{
+		mdnsDomain:   mdnsDomain,
+		hosts:        map[string]bool{},
+		contentTypes: map[string]bool{},
+	}
+	for _, host := range hosts {
+		if host == "*" {
+			b.allHosts = true
+			continue
+		}
+		b.hosts[b.trimMdnsDomain(host)] = true
+	}
+	for _, contentType := range contentTypes {
+		b.contentTypes[strings.ToLower(contentType)] = true
+	}
+	return b
+}
+
+func (b *BodyRewriter) trimMdnsDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), fmt.Sprintf(".%s", b.mdnsDomain))
+}
+
+// Enabled returns whether body rewriting is enabled for the given mDNS host.
+func (b *BodyRewriter) Enabled(host string) bool {
+	return b.allHosts || b.hosts[b.trimMdnsDomain(host)]
+}
+
+func (b *BodyRewriter) shouldRewrite(resp *http.Response) bool {
+	if resp.Request.Method == http.MethodHead {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if resp.Header.Get("Content-Range") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return b.contentTypes[strings.ToLower(mediaType)]
+}
+
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// Although "deflate" should be zlib wrapped, some servers send raw deflate
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	var err error
+	for _, closer := range d.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// SetAcceptEncoding restricts the Accept-Encoding header of an upstream request to the
+// encodings bodies can be rewritten from.
+func (b *BodyRewriter) SetAcceptEncoding(header http.Header) {
+	values := header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return
+	}
+	codings := []string{}
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.TrimSpace(coding)
+			name, _, _ := strings.Cut(coding, ";")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "gzip", "x-gzip", "deflate", "identity":
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		header.Set("Accept-Encoding", "identity")
+		return
+	}
+	header.Set("Accept-Encoding", strings.Join(codings, ", "))
+}
+
+// newDecoder returns a reader decoding r with the given content encoding, or nil for
+// unsupported encodings.
+func newDecoder(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(r), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return newDeflateReader(r)
+	}
+	return nil, nil
+}
+
+// Rewrite rewrites the response body, if its content type and encoding are supported.
+func (b *BodyRewriter) Rewrite(resp *http.Response, u upstream) error {
+	if !b.shouldRewrite(resp) {
+		return nil
+	}
+	encoding := resp.Header.Get("Content-Encoding")
+
+	if resp.ContentLength >= 0 && resp.ContentLength <= bodyRewriteMaxBuffer {
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, bodyRewriteMaxBuffer))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		decoder, err := newDecoder(encoding, bytes.NewReader(raw))
+		if err != nil || decoder == nil {
+			return err
+		}
+		// Decoded bodies are limited too, so small compressed bodies can not expand
+		// without bounds
+		decoded, err := io.ReadAll(io.LimitReader(decoder, bodyRewriteMaxBuffer+1))
+		decoder.Close()
+		if err != nil {
+			return err
+		}
+		if int64(len(decoded)) > bodyRewriteMaxBuffer {
+			return nil
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, &bodyRewriteReader{
+			source: bytes.NewReader(decoded),
+			u:      u,
+			buf:    make([]byte, 32*1024),
+		}); err != nil {
+			return err
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Body = io.NopCloser(&buf)
+		resp.ContentLength = int64(buf.Len())
+		resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	} else {
+		decoder, err := newDecoder(encoding, resp.Body)
+		if err != nil || decoder == nil {
+			return err
+		}
+		resp.Header.Del("Content-Encoding")
+		resp.Body = &decodedBody{
+			Reader: &bodyRewriteReader{
+				source: decoder,
+				u:      u,
+				buf:    make([]byte, 32*1024),
+			},
+			closers: []io.Closer{decoder, resp.Body},
+		}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	}
+	resp.Header.Del("Content-Md5")
+	// The body is no longer byte for byte identical
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
+
+type bodyRewriteReader struct {
+	source io.Reader
+	u      upstream
+	buf    []byte
+	in     []byte
+	out    bytes.Buffer
+	eof    bool
+	err    error
+}
+
+func (r *bodyRewriteReader) rewriteMatch(match []byte) []byte {
+	groups := bodyURLRegexp.FindSubmatch(match)
+	scheme := strings.ToLower(strings.TrimSuffix(string(groups[1]), ":"))
+	matchScheme := scheme
+	switch scheme {
+	case "":
+		matchScheme = r.u.url.Scheme
+	case "ws":
+		matchScheme = "http"
+	case "wss":
+		matchScheme = "https"
+	}
+	hostname := strings.Trim(string(groups[2]), "[]")
+	port := strings.TrimPrefix(string(groups[3]), ":")
+	base := r.u.publicBaseURL(hostname, matchScheme, port)
+	if base == nil {
+		return match
+	}
+	publicScheme := base.Scheme
+	switch scheme {
+	case "":
+		return []byte(fmt.Sprintf("//%s%s", base.Host, strings.TrimSuffix(base.Path, "/")))
+	case "ws", "wss":
+		publicScheme = "ws"
+		if base.Scheme == "https" {
+			publicScheme = "wss"
+		}
+	}
+	return []byte(fmt.Sprintf("%s://%s%s", publicScheme, base.Host, strings.TrimSuffix(base.Path, "/")))
+}
+
+// process rewrites buffered input into the output, holding back data which may be part
+// of an incomplete URL, unless at EOF.
+func (r *bodyRewriteReader) process() {
+	safe := len(r.in)
+	if !r.eof {
+		safe -= bodyRewriteHoldback
+		if safe <= 0 {
+			return
+		}
+	}
+	var last int
+	for _, loc := range bodyURLRegexp.FindAllIndex(r.in, -1) {
+		if loc[0] >= safe {
+			break
+		}
+		if !r.eof && loc[1] == len(r.in) {
+			safe = loc[0]
+			break
+		}
+		r.out.Write(r.in[last:loc[0]])
+		r.out.Write(r.rewriteMatch(r.in[loc[0]:loc[1]]))
+		last = loc[1]
+	}
+	if safe < last {
+		safe = last
+	}
+	r.out.Write(r.in[last:safe])
+	r.in = append(r.in[:0], r.in[safe:]...)
+}
+
+func (r *bodyRewriteReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.eof {
+			return 0, io.EOF
+		}
+		n, err := r.source.Read(r.buf)
+		r.in = append(r.in, r.buf[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			r.err = err
+		}
+		r.process()
+	}
+	return r.out.Read(p)
+}
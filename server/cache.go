@@ -0,0 +1,677 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheMetrics = expvar.NewMap("cache")
+
+// cacheHeuristicMaxAge caps the freshness lifetime computed from Last-Modified.
+var cacheHeuristicMaxAge = 24 * time.Hour
+
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+var cacheFileSuffix = ".cache"
+
+type cacheRule struct {
+	host *regexp.Regexp
+	path *regexp.Regexp
+	// ttl overrides the freshness lifetime of responses, 0 disables caching.
+	ttl time.Duration
+}
+
+// globToRegexp converts a glob, where "*" matches anything but "/" and "**" matches
+// anything, to a regexp.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			expr.WriteString("[^/]*")
+		case glob[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+type cacheEntry struct {
+	key    string
+	host   string
+	path   string
+	status int
+	header http.Header
+	// varyHeader holds the request headers the response varies on.
+	varyHeader http.Header
+	// body is kept in memory, unless the cache is disk backed.
+	body     []byte
+	size     int64
+	storedAt time.Time
+	// initialAge is the age of the response when it was stored.
+	initialAge time.Duration
+	lifetime   time.Duration
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.storedAt)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.lifetime
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.header.Get("Etag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// Cache is a shared HTTP cache for upstream responses, honoring Cache-Control, ETag and
+// Last-Modified, with per host and path overrides. Entries are evicted in least recently
+// used order to stay within the size limit.
+type Cache struct {
+	enabled      bool
+	mdnsDomain   string
+	maxSize      int64
+	maxEntrySize int64
+	dir          string
+	rules        []cacheRule
+
+	mutex   sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// NewCache creates a new Cache.
+//   - maxSize: maximum total size of cached bodies.
+//   - maxEntrySize: maximum size of a single cached body.
+//   - dir: if not empty, bodies are stored in this directory instead of memory.
+//   - rules: overrides, in the format "host/path=ttl", where host and path are globs ("*"
+//     matches anything but "/", "**" matches anything), and ttl is the freshness lifetime
+//     of matching responses, or 0 to not cache them. The first matching rule is used.
+func NewCache(
+	enabled bool,
+	mdnsDomain string,
+	maxSize int64,
+	maxEntrySize int64,
+	dir string,
+	rules []string,
+) (*Cache, error) {
+	c := &Cache{
+		enabled:      enabled,
+		mdnsDomain:   mdnsDomain,
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+		dir:          dir,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+	}
+	if maxSize < 0 || maxEntrySize < 0 {
+		return nil, fmt.Errorf("sizes must not be negative")
+	}
+	for _, rule := range rules {
+		target, ttlStr, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %#v: must be in the format host/path=ttl", rule)
+		}
+		hostGlob, pathGlob, ok := strings.Cut(target, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %#v: must be in the format host/path=ttl", rule)
+		}
+		if _, err := path.Match(hostGlob, ""); err != nil {
+			return nil, fmt.Errorf("invalid rule %#v: %w", rule, err)
+		}
+		hostRegexp, err := globToRegexp(c.trimMdnsDomain(hostGlob))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %#v: %w", rule, err)
+		}
+		pathRegexp, err := globToRegexp("/" + pathGlob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %#v: %w", rule, err)
+		}
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %#v: %w", rule, err)
+		}
+		if ttl < 0 {
+			return nil, fmt.Errorf("invalid rule %#v: ttl must not be negative", rule)
+		}
+		c.rules = append(c.rules, cacheRule{
+			host: hostRegexp,
+			path: pathRegexp,
+			ttl:  ttl,
+		})
+	}
+	if enabled && dir != "" {
+		if err := c.cleanDir(); err != nil {
+			return nil, err
+		}
+	}
+	cacheMetrics.Set("size", expvar.Func(func() any {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.size
+	}))
+	cacheMetrics.Set("entries", expvar.Func(func() any {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.lru.Len()
+	}))
+	return c, nil
+}
+
+// cleanDir removes bodies left in the cache directory by previous runs, as the index is
+// only kept in memory.
+func (c *Cache) cleanDir() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	dirEntries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), cacheFileSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, dirEntry.Name())); err != nil {
+			return fmt.Errorf("failed to clean cache directory: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Cache) trimMdnsDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), fmt.Sprintf(".%s", c.mdnsDomain))
+}
+
+func (c *Cache) getRule(host, urlPath string) *cacheRule {
+	host = c.trimMdnsDomain(host)
+	for i, rule := range c.rules {
+		if rule.host.MatchString(host) && rule.path.MatchString(urlPath) {
+			return &c.rules[i]
+		}
+	}
+	return nil
+}
+
+// getHostname returns the mDNS host of an upstream request, without the port.
+func (c *Cache) getHostname(req *http.Request) string {
+	if hostname, _, err := net.SplitHostPort(req.Host); err == nil {
+		return hostname
+	}
+	return req.Host
+}
+
+// getKey identifies responses by the host and port of the upstream request, as hosts may
+// serve different services at each port.
+func (c *Cache) getKey(req *http.Request) string {
+	return net.JoinHostPort(strings.ToLower(c.getHostname(req)), req.URL.Port()) + req.URL.RequestURI()
+}
+
+func (c *Cache) bodyFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+// removeElement must be called with the mutex held.
+func (c *Cache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	if c.dir != "" {
+		os.Remove(c.bodyFile(entry.key))
+	}
+}
+
+func (c *Cache) get(key string) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (c *Cache) delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+func (c *Cache) put(entry *cacheEntry, body []byte) {
+	if c.dir != "" {
+		file, err := os.CreateTemp(c.dir, "tmp-*")
+		if err != nil {
+			return
+		}
+		_, err = file.Write(body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), c.bodyFile(entry.key))
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return
+		}
+	} else {
+		entry.body = body
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		// The body file was replaced above, so it must not be removed
+		old := c.lru.Remove(element).(*cacheEntry)
+		delete(c.entries, old.key)
+		c.size -= old.size
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+		cacheMetrics.Add("evictions", 1)
+	}
+}
+
+// Purge removes cached responses for the given mDNS host (all hosts if empty) with paths
+// starting with pathPrefix, returning the number of removed responses.
+func (c *Cache) Purge(host string, pathPrefix string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var purged int
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cacheEntry)
+		if (host == "" || c.trimMdnsDomain(host) == c.trimMdnsDomain(entry.host)) &&
+			strings.HasPrefix(entry.path, pathPrefix) {
+			c.removeElement(element)
+			purged++
+		}
+		element = next
+	}
+	cacheMetrics.Add("purged", int64(purged))
+	return purged
+}
+
+// getLifetime returns the freshness lifetime of a response, and whether it can be
+// stored at all.
+func (c *Cache) getLifetime(req *http.Request, resp *http.Response, rule *cacheRule) (time.Duration, bool) {
+	if !cacheableStatus[resp.StatusCode] {
+		return 0, false
+	}
+	directives := parseCacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := directives["private"]; ok {
+		return 0, false
+	}
+	// Responses setting cookies are likely to be specific to a client
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	_, public := directives["public"]
+	if req.Header.Get("Authorization") != "" {
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return 0, false
+		}
+	}
+	// Responses to requests with cookies are likely to be specific to a client too
+	if req.Header.Get("Cookie") != "" && !public {
+		return 0, false
+	}
+	// Rules only override freshness, as responses for a single client must never be shared
+	if rule != nil {
+		return rule.ttl, rule.ttl > 0
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return 0, true
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	if expiresStr := resp.Header.Get("Expires"); expiresStr != "" {
+		expires, err := http.ParseTime(expiresStr)
+		if err != nil || expires.Before(date) {
+			return 0, true
+		}
+		return expires.Sub(date), true
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > cacheHeuristicMaxAge {
+			lifetime = cacheHeuristicMaxAge
+		}
+		return lifetime, true
+	}
+	return 0, resp.Header.Get("Etag") != ""
+}
+
+func parseCacheControl(header http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if key == "" {
+				continue
+			}
+			directives[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// varyHeader returns the request headers the response varies on, or false if they can
+// not be matched (Vary: *).
+func varyHeader(req *http.Request, respHeader http.Header) (http.Header, bool) {
+	header := http.Header{}
+	for _, value := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			header[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+		}
+	}
+	return header, true
+}
+
+func (e *cacheEntry) matchesVary(req *http.Request) bool {
+	for name, values := range e.varyHeader {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// notModified returns whether the conditional request can be answered with 304 Not
+// Modified.
+func (e *cacheEntry) notModified(req *http.Request) bool {
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(e.header.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(ifModifiedSince)
+}
+
+func (c *Cache) response(req *http.Request, entry *cacheEntry, status string) (*http.Response, error) {
+	header := entry.header.Clone()
+	header.Set("Age", strconv.Itoa(int(entry.age(time.Now()).Seconds())))
+	header.Set("X-Cache", status)
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", entry.status, http.StatusText(entry.status)),
+		StatusCode: entry.status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Request:    req,
+	}
+	if entry.notModified(req) {
+		resp.Status = fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified))
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		header.Del("Content-Length")
+		return resp, nil
+	}
+	resp.ContentLength = entry.size
+	header.Set("Content-Length", strconv.FormatInt(entry.size, 10))
+	if c.dir == "" {
+		resp.Body = io.NopCloser(bytes.NewReader(entry.body))
+		return resp, nil
+	}
+	file, err := os.Open(c.bodyFile(entry.key))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = file
+	return resp, nil
+}
+
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// RoundTrip serves the request from the cache, or with next, storing its response.
+func (c *Cache) RoundTrip(
+	req *http.Request,
+	next func(*http.Request) (*http.Response, error),
+) (*http.Response, error) {
+	if !c.enabled {
+		return next(req)
+	}
+	key := c.getKey(req)
+
+	if isUnsafeMethod(req.Method) {
+		resp, err := next(req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			c.delete(key)
+		}
+		return resp, err
+	}
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return next(req)
+	}
+	rule := c.getRule(c.getHostname(req), req.URL.Path)
+	if rule != nil && rule.ttl == 0 {
+		return next(req)
+	}
+	requestDirectives := parseCacheControl(req.Header)
+	if _, ok := requestDirectives["no-store"]; ok {
+		return next(req)
+	}
+
+	entry := c.get(key)
+	if entry != nil && !entry.matchesVary(req) {
+		entry = nil
+	}
+	if entry != nil {
+		_, noCache := requestDirectives["no-cache"]
+		if !noCache && req.Header.Get("Pragma") != "no-cache" && entry.fresh(time.Now()) {
+			resp, err := c.response(req, entry, "HIT")
+			if err == nil {
+				cacheMetrics.Add("hits", 1)
+				return resp, nil
+			}
+			c.delete(key)
+			entry = nil
+		}
+	}
+
+	upstreamReq := req
+	if entry != nil && entry.hasValidators() {
+		// Revalidate with the cached response validators, client conditionals are evaluated
+		// against the cached response.
+		upstreamReq = req.Clone(req.Context())
+		for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+			upstreamReq.Header.Del(name)
+		}
+		if etag := entry.header.Get("Etag"); etag != "" {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		} else {
+			upstreamReq.Header.Set("If-Modified-Since", entry.header.Get("Last-Modified"))
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := next(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry != nil && upstreamReq != req && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := *entry
+		updated.header = entry.header.Clone()
+		for name, values := range resp.Header {
+			if name == "Content-Length" {
+				continue
+			}
+			updated.header[name] = values
+		}
+		updated.storedAt = time.Now()
+		updated.initialAge = c.getInitialAge(resp, requestTime)
+		updated.lifetime = entry.lifetime
+		if lifetime, ok := c.getLifetime(req, &http.Response{StatusCode: entry.status, Header: updated.header}, rule); ok {
+			updated.lifetime = lifetime
+		}
+		c.mutex.Lock()
+		if element, ok := c.entries[key]; ok && element.Value == entry {
+			element.Value = &updated
+		}
+		c.mutex.Unlock()
+		cacheMetrics.Add("revalidated", 1)
+		return c.response(req, &updated, "REVALIDATED")
+	}
+
+	cacheMetrics.Add("misses", 1)
+	resp.Header.Set("X-Cache", "MISS")
+	if resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+	lifetime, ok := c.getLifetime(req, resp, rule)
+	if !ok {
+		c.delete(key)
+		return resp, nil
+	}
+	vary, ok := varyHeader(req, resp.Header)
+	if !ok || resp.ContentLength > c.maxEntrySize || resp.Header.Get("Content-Range") != "" {
+		c.delete(key)
+		return resp, nil
+	}
+	header := resp.Header.Clone()
+	header.Del("X-Cache")
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade"} {
+		header.Del(name)
+	}
+	resp.Body = &cacheBodyReader{
+		ReadCloser: resp.Body,
+		maxSize:    c.maxEntrySize,
+		store: func(body []byte) {
+			c.put(&cacheEntry{
+				key:        key,
+				host:       c.getHostname(req),
+				path:       req.URL.Path,
+				status:     resp.StatusCode,
+				header:     header,
+				varyHeader: vary,
+				size:       int64(len(body)),
+				storedAt:   time.Now(),
+				initialAge: c.getInitialAge(resp, requestTime),
+				lifetime:   lifetime,
+			}, body)
+		},
+	}
+	return resp, nil
+}
+
+func (c *Cache) getInitialAge(resp *http.Response, requestTime time.Time) time.Duration {
+	age := time.Since(requestTime)
+	if seconds, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age
+}
+
+// cacheBodyReader copies the body while it is read, storing it once fully read, unless
+// larger than maxSize.
+type cacheBodyReader struct {
+	io.ReadCloser
+	maxSize  int64
+	buf      bytes.Buffer
+	tooLarge bool
+	store    func([]byte)
+}
+
+func (r *cacheBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if !r.tooLarge {
+		if int64(r.buf.Len()+n) > r.maxSize {
+			r.tooLarge = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(p[:n])
+		}
+	}
+	if errors.Is(err, io.EOF) && !r.tooLarge {
+		r.store(r.buf.Bytes())
+		r.tooLarge = true
+	}
+	return n, err
+}
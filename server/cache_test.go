@@ -0,0 +1,197 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheGetLifetime(t *testing.T) {
+	cache, err := NewCache(false, "local", 0, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rule := &cacheRule{ttl: time.Hour}
+	disabledRule := &cacheRule{ttl: 0}
+
+	for _, tc := range []struct {
+		name           string
+		requestHeader  http.Header
+		status         int
+		responseHeader http.Header
+		rule           *cacheRule
+		lifetime       time.Duration
+		store          bool
+	}{
+		{
+			name:           "max-age",
+			responseHeader: http.Header{"Cache-Control": {"max-age=60"}},
+			lifetime:       time.Minute,
+			store:          true,
+		},
+		{
+			name:           "s-maxage over max-age",
+			responseHeader: http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}},
+			lifetime:       2 * time.Minute,
+			store:          true,
+		},
+		{
+			name:           "invalid max-age",
+			responseHeader: http.Header{"Cache-Control": {"max-age=foo"}},
+			lifetime:       0,
+			store:          true,
+		},
+		{
+			name:           "no-cache",
+			responseHeader: http.Header{"Cache-Control": {"no-cache"}},
+			lifetime:       0,
+			store:          true,
+		},
+		{
+			name:           "no-store",
+			responseHeader: http.Header{"Cache-Control": {"no-store, max-age=60"}},
+		},
+		{
+			name:           "private",
+			responseHeader: http.Header{"Cache-Control": {"private, max-age=60"}},
+		},
+		{
+			name:           "uncacheable status",
+			status:         http.StatusInternalServerError,
+			responseHeader: http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			name: "expires",
+			responseHeader: http.Header{
+				"Date":    {date.Format(http.TimeFormat)},
+				"Expires": {date.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			lifetime: time.Hour,
+			store:    true,
+		},
+		{
+			name: "expires in the past",
+			responseHeader: http.Header{
+				"Date":    {date.Format(http.TimeFormat)},
+				"Expires": {date.Add(-time.Hour).Format(http.TimeFormat)},
+			},
+			lifetime: 0,
+			store:    true,
+		},
+		{
+			name: "last-modified heuristic",
+			responseHeader: http.Header{
+				"Date":          {date.Format(http.TimeFormat)},
+				"Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)},
+			},
+			lifetime: time.Hour,
+			store:    true,
+		},
+		{
+			name:           "etag only",
+			responseHeader: http.Header{"Etag": {`"foo"`}},
+			lifetime:       0,
+			store:          true,
+		},
+		{
+			name: "no validators",
+		},
+		{
+			name:           "set-cookie",
+			responseHeader: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=foo"}},
+		},
+		{
+			name:           "authorization",
+			requestHeader:  http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}},
+			responseHeader: http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			name:           "authorization with public",
+			requestHeader:  http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}},
+			responseHeader: http.Header{"Cache-Control": {"public, max-age=60"}},
+			lifetime:       time.Minute,
+			store:          true,
+		},
+		{
+			name:           "cookie",
+			requestHeader:  http.Header{"Cookie": {"session=foo"}},
+			responseHeader: http.Header{"Cache-Control": {"max-age=60"}},
+		},
+		{
+			name:           "cookie with public",
+			requestHeader:  http.Header{"Cookie": {"session=foo"}},
+			responseHeader: http.Header{"Cache-Control": {"public, max-age=60"}},
+			lifetime:       time.Minute,
+			store:          true,
+		},
+		{
+			name:     "rule",
+			rule:     rule,
+			lifetime: time.Hour,
+			store:    true,
+		},
+		{
+			name:           "rule overrides no-cache",
+			responseHeader: http.Header{"Cache-Control": {"no-cache"}},
+			rule:           rule,
+			lifetime:       time.Hour,
+			store:          true,
+		},
+		{
+			name: "rule disabling caching",
+			rule: disabledRule,
+		},
+		{
+			name:           "rule with no-store",
+			responseHeader: http.Header{"Cache-Control": {"no-store"}},
+			rule:           rule,
+		},
+		{
+			name:           "rule with private",
+			responseHeader: http.Header{"Cache-Control": {"private"}},
+			rule:           rule,
+		},
+		{
+			name:           "rule with set-cookie",
+			responseHeader: http.Header{"Set-Cookie": {"session=foo"}},
+			rule:           rule,
+		},
+		{
+			name:          "rule with authorization",
+			requestHeader: http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}},
+			rule:          rule,
+		},
+		{
+			name:          "rule with cookie",
+			requestHeader: http.Header{"Cookie": {"session=foo"}},
+			rule:          rule,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://foo.local/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, values := range tc.requestHeader {
+				req.Header[key] = values
+			}
+			status := tc.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			resp := &http.Response{StatusCode: status, Header: http.Header{}}
+			for key, values := range tc.responseHeader {
+				resp.Header[http.CanonicalHeaderKey(key)] = values
+			}
+
+			lifetime, store := cache.getLifetime(req, resp, tc.rule)
+			if store != tc.store {
+				t.Fatalf("expected store %v, got %v", tc.store, store)
+			}
+			if store && lifetime != tc.lifetime {
+				t.Fatalf("expected lifetime %v, got %v", tc.lifetime, lifetime)
+			}
+		})
+	}
+}
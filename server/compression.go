@@ -0,0 +1,351 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/http/httpguts"
+)
+
+// DefaultCompressionEncodings are the supported encodings, in order of preference.
+var DefaultCompressionEncodings = []string{"br", "zstd", "gzip"}
+
+// DefaultCompressionContentTypes are the content types which are compressed by default.
+var DefaultCompressionContentTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/x-javascript",
+	"application/xhtml+xml",
+	"application/xml",
+	"image/svg+xml",
+	"text/css",
+	"text/html",
+	"text/javascript",
+	"text/plain",
+	"text/xml",
+}
+
+var compressionEncoders = map[string]func(io.Writer) (io.WriteCloser, error){
+	"br": func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	},
+	"zstd": func(w io.Writer) (io.WriteCloser, error) {
+		// Browsers refuse windows larger than 8MiB
+		return zstd.NewWriter(
+			w,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(8*1024*1024),
+		)
+	},
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+}
+
+// Compressor compresses responses with an encoding negotiated with the client's
+// Accept-Encoding. Responses of unknown length are only compressed when their first flush
+// reaches the minimum size, as they are flushed as they are written.
+type Compressor struct {
+	enabled       bool
+	mdnsDomain    string
+	encodings     []string
+	contentTypes  map[string]bool
+	minSize       int
+	disabledHosts map[string]bool
+}
+
+// NewCompressor creates a new Compressor for responses of the given content types, of at
+// least minSize bytes, with the given encodings (in order of preference). Compression can
+// be disabled for some mDNS hosts with disabledHosts.
+func NewCompressor(
+	enabled bool,
+	mdnsDomain string,
+	encodings []string,
+	contentTypes []string,
+	minSize int,
+	disabledHosts []string,
+) (*Compressor, error) {
+	c := &Compressor{
+		enabled:       enabled,
+		mdnsDomain:    mdnsDomain,
+		contentTypes:  map[string]bool{},
+		minSize:       minSize,
+		disabledHosts: map[string]bool{},
+	}
+	for _, encoding := range encodings {
+		encoding = strings.ToLower(encoding)
+		if _, ok := compressionEncoders[encoding]; !ok {
+			return nil, fmt.Errorf("unsupported encoding %#v: must be one of br, zstd or gzip", encoding)
+		}
+		c.encodings = append(c.encodings, encoding)
+	}
+	if enabled && len(c.encodings) == 0 {
+		return nil, fmt.Errorf("at least one encoding is required")
+	}
+	for _, contentType := range contentTypes {
+		c.contentTypes[strings.ToLower(contentType)] = true
+	}
+	for _, host := range disabledHosts {
+		c.disabledHosts[c.trimMdnsDomain(host)] = true
+	}
+	return c, nil
+}
+
+func (c *Compressor) trimMdnsDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), fmt.Sprintf(".%s", c.mdnsDomain))
+}
+
+// negotiate returns the encodings accepted by the client, from the most preferred.
+func (c *Compressor) negotiate(acceptEncoding string) []string {
+	qValues := map[string]float64{}
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if !ok || !strings.EqualFold(key, "q") {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				parsed = 0
+			}
+			q = parsed
+		}
+		qValues[coding] = q
+	}
+
+	encodings := []string{}
+	for _, encoding := range c.encodings {
+		q, ok := qValues[encoding]
+		if !ok {
+			q = qValues["*"]
+			qValues[encoding] = q
+		}
+		if q > 0 {
+			encodings = append(encodings, encoding)
+		}
+	}
+	sort.SliceStable(encodings, func(i, j int) bool {
+		return qValues[encodings[i]] > qValues[encodings[j]]
+	})
+	return encodings
+}
+
+// Wrap returns a ResponseWriter which compresses the response to req, for the given mDNS
+// host (empty for responses not proxied from a host). done must be called once the
+// response is fully written.
+func (c *Compressor) Wrap(
+	w http.ResponseWriter,
+	req *http.Request,
+	host string,
+) (http.ResponseWriter, func()) {
+	if !c.enabled || c.disabledHosts[c.trimMdnsDomain(host)] {
+		return w, func() {}
+	}
+	// WebSockets and Server-Sent Events must not be buffered
+	if req.Method == http.MethodHead || getStreamKind(req) != "" {
+		return w, func() {}
+	}
+	cw := &compressResponseWriter{
+		ResponseWriter: w,
+		c:              c,
+		encodings:      c.negotiate(req.Header.Get("Accept-Encoding")),
+	}
+	return cw, cw.close
+}
+
+func (c *Compressor) compressible(header http.Header, status int) bool {
+	if status < http.StatusOK {
+		return false
+	}
+	switch status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if httpguts.HeaderValuesContainsToken(header["Cache-Control"], "no-transform") {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	mediaType = strings.ToLower(mediaType)
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	return c.contentTypes[mediaType]
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	c         *Compressor
+	encodings []string
+
+	status      int
+	wroteHeader bool
+	// decided is set once it is known whether the response is compressed, until then
+	// the body is buffered.
+	decided bool
+	buf     []byte
+	encoder io.WriteCloser
+}
+
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses are sent as is
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+
+	header := cw.Header()
+	if !cw.c.compressible(header, status) {
+		cw.passthrough()
+		return
+	}
+	header.Add("Vary", "Accept-Encoding")
+	if len(cw.encodings) == 0 {
+		cw.passthrough()
+		return
+	}
+	if contentLength, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		if contentLength < cw.c.minSize {
+			cw.passthrough()
+		} else {
+			cw.compress()
+		}
+	}
+}
+
+func (cw *compressResponseWriter) passthrough() {
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// compress sends the response compressed with the first encoding which has an encoder
+// available, or uncompressed if none has.
+func (cw *compressResponseWriter) compress() {
+	var encoding string
+	for _, encoding = range cw.encodings {
+		if encoder, err := compressionEncoders[encoding](cw.ResponseWriter); err == nil {
+			cw.encoder = encoder
+			break
+		}
+	}
+	if cw.encoder == nil {
+		cw.passthrough()
+		return
+	}
+	cw.decided = true
+	header := cw.Header()
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	header.Del("Content-Md5")
+	header.Del("Accept-Ranges")
+	// The body is no longer byte for byte identical
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.c.minSize {
+			return len(b), nil
+		}
+		cw.compress()
+		buf := cw.buf
+		cw.buf = nil
+		if cw.encoder == nil {
+			if _, err := cw.ResponseWriter.Write(buf); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		if _, err := cw.encoder.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressResponseWriter) FlushError() error {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	// Flushing means the response is streamed, so no point in waiting for more data. Write
+	// would have already compressed it if the buffered data reached the minimum size, so it is
+	// sent as is.
+	if !cw.decided {
+		cw.passthrough()
+		buf := cw.buf
+		cw.buf = nil
+		if _, err := cw.ResponseWriter.Write(buf); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressResponseWriter) Flush() {
+	cw.FlushError()
+}
+
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressResponseWriter) close() {
+	if !cw.wroteHeader {
+		return
+	}
+	if !cw.decided {
+		// Too small to be worth compressing
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		cw.passthrough()
+		cw.ResponseWriter.Write(cw.buf)
+		return
+	}
+	if cw.encoder != nil {
+		cw.encoder.Close()
+	}
+}
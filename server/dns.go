@@ -0,0 +1,452 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// dnsSDInstance is a discovered service published with DNS-SD under the base domain.
+type dnsSDInstance struct {
+	name  string
+	label string
+	txt   []string
+}
+
+// DNSServer is an authoritative DNS server (UDP and TCP) for the base domain, answering
+// queries for it and for discovered hosts (${mdns_host}.${baseDomain}) with the addresses of
+// the proxy.
+type DNSServer struct {
+	addr            string
+	baseDomain      string
+	service         string
+	mdnsDomain      string
+	answerIPs       []net.IP
+	ttl             time.Duration
+	refreshInterval time.Duration
+	browse          func(context.Context, string) ([]mdns.Service, error)
+	hostAliases     *HostAliases
+	hostPolicy      *HostPolicy
+	gateway         *DNSGateway
+	sdServiceType   string
+	sdPort          uint16
+	mux             *dns.ServeMux
+
+	mutex sync.Mutex
+	// hosts is the set of discovered and allowed mDNS host labels.
+	hosts map[string]bool
+	// sdInstances are the discovered and allowed services, by lower case instance name.
+	sdInstances map[string]dnsSDInstance
+
+	udpServer *dns.Server
+	tcpServer *dns.Server
+	// ctx and logger are set by Serve before answering queries.
+	ctx    context.Context
+	logger *logrus.Logger
+	// cancel and closed are guarded by mutex, as Close may be called before Serve.
+	cancel context.CancelFunc
+	closed bool
+}
+
+// NewDNSServer creates a new DNSServer listening at addr.
+//   - answerAddresses: addresses to answer with. If empty, the address queries are received
+//     at is used, or when listening on all addresses, the global unicast addresses of all
+//     interfaces.
+//   - ttl: TTL of answers.
+//   - refreshInterval: how often discovered hosts are refreshed.
+//   - gateway: when enabled, answers queries for mDNS names.
+//   - sdServiceType: when not empty, discovered services are published with DNS-SD under
+//     the base domain as this service type (eg: _http._tcp), pointing to the proxy at sdPort.
+func NewDNSServer(
+	addr string,
+	baseDomain string,
+	ifaceName string,
+	service string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	answerAddresses []string,
+	ttl time.Duration,
+	refreshInterval time.Duration,
+	gateway *DNSGateway,
+	sdServiceType string,
+	sdPort uint16,
+) (*DNSServer, error) {
+	s := &DNSServer{
+		addr:            addr,
+		baseDomain:      dns.CanonicalName(baseDomain),
+		service:         service,
+		mdnsDomain:      mdnsDomain,
+		ttl:             ttl,
+		refreshInterval: refreshInterval,
+		browse:          getServiceBrowser(ifaceName, mdnsDomain, timeout, getProto(disableIPv4, disableIPv6)),
+		hostAliases:     hostAliases,
+		hostPolicy:      hostPolicy,
+		gateway:         gateway,
+		sdServiceType:   strings.ToLower(sdServiceType),
+		sdPort:          sdPort,
+		mux:             dns.NewServeMux(),
+		hosts:           map[string]bool{},
+		sdInstances:     map[string]dnsSDInstance{},
+	}
+	for _, address := range answerAddresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid answer address: %#v", address)
+		}
+		s.answerIPs = append(s.answerIPs, ip)
+	}
+	if refreshInterval <= 0 {
+		return nil, fmt.Errorf("refresh interval must be positive")
+	}
+	if s.sdServiceType != "" {
+		if labels := dns.SplitDomainName(s.sdServiceType); len(labels) != 2 ||
+			!strings.HasPrefix(labels[0], "_") || (labels[1] != "_tcp" && labels[1] != "_udp") {
+			return nil, fmt.Errorf("invalid DNS-SD service type: %#v", sdServiceType)
+		}
+		if sdPort == 0 {
+			return nil, fmt.Errorf("DNS-SD port must be set")
+		}
+	}
+	s.mux.HandleFunc(s.baseDomain, s.serveBaseDomain)
+	if gateway.enabled {
+		s.mux.HandleFunc(dns.Fqdn(mdnsDomain), func(w dns.ResponseWriter, req *dns.Msg) {
+			gateway.serve(s.ctx, s.logger, w, req)
+		})
+	}
+	s.mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+	})
+	return s, nil
+}
+
+// Listen starts listening on UDP and TCP.
+func (s *DNSServer) Listen() error {
+	packetConn, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("error listening on udp %s: %w", s.addr, err)
+	}
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		packetConn.Close()
+		return fmt.Errorf("error listening on tcp %s: %w", s.addr, err)
+	}
+	s.udpServer = &dns.Server{PacketConn: packetConn, Handler: s.mux}
+	s.tcpServer = &dns.Server{Listener: listener, Handler: s.mux}
+	return nil
+}
+
+// Serve answers queries, until Close is called.
+func (s *DNSServer) Serve(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	s.logger = logger
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.ctx = ctx
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.cancel = cancel
+	s.mutex.Unlock()
+
+	// Hosts are discovered before answering, so known hosts are not answered with NXDOMAIN,
+	// which resolvers would cache
+	s.refresh(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(s.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.refresh(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	logger.Infof("Starting DNS server on %s", s.addr)
+	var wg sync.WaitGroup
+	for _, server := range []*dns.Server{s.udpServer, s.tcpServer} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.ActivateAndServe(); err != nil && !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("DNS server error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Close stops the server.
+func (s *DNSServer) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mutex.Unlock()
+	for _, server := range []*dns.Server{s.udpServer, s.tcpServer} {
+		if server != nil {
+			server.Shutdown()
+		}
+	}
+	// Servers which were not started yet are not shut down above
+	if s.udpServer != nil {
+		s.udpServer.PacketConn.Close()
+	}
+	if s.tcpServer != nil {
+		s.tcpServer.Listener.Close()
+	}
+}
+
+func (s *DNSServer) refresh(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	services, err := s.browse(ctx, s.service)
+	if err != nil {
+		logger.Errorf("Error refreshing DNS hosts: %v", err)
+		return
+	}
+	s.hostAliases.Learn(services)
+	s.hostPolicy.Learn(s.service, services)
+	hosts := map[string]bool{}
+	sdInstances := map[string]dnsSDInstance{}
+	for _, service := range services {
+		allowed, err := s.hostPolicy.Allowed(ctx, service.Host, s.browse)
+		if err != nil {
+			logger.Errorf("Error checking host policy for '%s': %v", service.Host, err)
+			return
+		}
+		if !allowed {
+			continue
+		}
+		hosts[strings.TrimSuffix(strings.ToLower(service.Host), fmt.Sprintf(".%s", s.mdnsDomain))] = true
+		// Only services at the port proxied to are advertised
+		if service.Port != 80 {
+			continue
+		}
+		key := strings.ToLower(service.Name)
+		if _, ok := sdInstances[key]; ok || service.Name == "" {
+			continue
+		}
+		txt := []string{}
+		for k, v := range service.Txt {
+			txt = append(txt, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(txt)
+		sdInstances[key] = dnsSDInstance{
+			name:  service.Name,
+			label: s.hostAliases.Alias(service.Host),
+			txt:   txt,
+		}
+	}
+	s.mutex.Lock()
+	s.hosts = hosts
+	s.sdInstances = sdInstances
+	s.mutex.Unlock()
+}
+
+func (s *DNSServer) knownHost(label string) bool {
+	host, _ := s.hostAliases.Lookup(label)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.hosts[host]
+}
+
+// getAnswerIPs returns the addresses to answer with, for a query received at localAddr.
+func (s *DNSServer) getAnswerIPs(localAddr net.Addr) []net.IP {
+	if len(s.answerIPs) > 0 {
+		return s.answerIPs
+	}
+	var localIP net.IP
+	switch addr := localAddr.(type) {
+	case *net.UDPAddr:
+		localIP = addr.IP
+	case *net.TCPAddr:
+		localIP = addr.IP
+	}
+	if localIP != nil && !localIP.IsUnspecified() {
+		return []net.IP{localIP}
+	}
+	ips := []net.IP{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// soa returns the SOA record of the base domain, for negative answers.
+func (s *DNSServer) soa() dns.RR {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   s.baseDomain,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.ttl.Seconds()),
+		},
+		Ns:      s.baseDomain,
+		Mbox:    "hostmaster." + s.baseDomain,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(s.ttl.Seconds()),
+	}
+}
+
+// getDNSSDAnswer returns the DNS-SD answer for name, and whether name is a DNS-SD name.
+func (s *DNSServer) getDNSSDAnswer(question dns.Question, name string) ([]dns.RR, bool) {
+	if s.sdServiceType == "" {
+		return nil, false
+	}
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.ttl.Seconds()),
+	}
+	serviceType := fmt.Sprintf("%s.%s", s.sdServiceType, s.baseDomain)
+	var ptrs []string
+	switch name {
+	case "b._dns-sd._udp." + s.baseDomain, "lb._dns-sd._udp." + s.baseDomain:
+		ptrs = []string{s.baseDomain}
+	case "_services._dns-sd._udp." + s.baseDomain:
+		ptrs = []string{serviceType}
+	case serviceType:
+		s.mutex.Lock()
+		for _, instance := range s.sdInstances {
+			ptrs = append(ptrs, fmt.Sprintf("%s.%s", escapeLabel(instance.name), serviceType))
+		}
+		s.mutex.Unlock()
+		sort.Strings(ptrs)
+	}
+	if ptrs != nil {
+		answer := []dns.RR{}
+		if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+			header.Rrtype = dns.TypePTR
+			for _, ptr := range ptrs {
+				answer = append(answer, &dns.PTR{Hdr: header, Ptr: ptr})
+			}
+		}
+		return answer, true
+	}
+
+	instanceLabel, ok := strings.CutSuffix(name, "."+serviceType)
+	if !ok {
+		return nil, false
+	}
+	s.mutex.Lock()
+	instance, ok := s.sdInstances[strings.ToLower(unescapeLabel(instanceLabel))]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	answer := []dns.RR{}
+	if question.Qtype == dns.TypeSRV || question.Qtype == dns.TypeANY {
+		srvHeader := header
+		srvHeader.Rrtype = dns.TypeSRV
+		answer = append(answer, &dns.SRV{
+			Hdr:    srvHeader,
+			Target: fmt.Sprintf("%s.%s", instance.label, s.baseDomain),
+			Port:   s.sdPort,
+		})
+	}
+	if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		txtHeader := header
+		txtHeader.Rrtype = dns.TypeTXT
+		txt := instance.txt
+		if len(txt) == 0 {
+			txt = []string{""}
+		}
+		answer = append(answer, &dns.TXT{Hdr: txtHeader, Txt: txt})
+	}
+	return answer, true
+}
+
+func (s *DNSServer) serveBaseDomain(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	if len(req.Question) != 1 {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+	question := req.Question[0]
+	name := dns.CanonicalName(question.Name)
+
+	if answer, ok := s.getDNSSDAnswer(question, name); ok {
+		resp.Answer = answer
+		if len(resp.Answer) == 0 {
+			resp.Ns = []dns.RR{s.soa()}
+		}
+		w.WriteMsg(resp)
+		return
+	}
+
+	if name != s.baseDomain {
+		label := strings.TrimSuffix(name, "."+s.baseDomain)
+		if strings.Contains(label, ".") || !s.knownHost(label) {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{s.soa()}
+			w.WriteMsg(resp)
+			return
+		}
+	}
+
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(s.ttl.Seconds()),
+	}
+	for _, ip := range s.getAnswerIPs(w.LocalAddr()) {
+		switch {
+		case question.Qtype == dns.TypeA && ip.To4() != nil:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: header, A: ip.To4()})
+		case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	if question.Qtype == dns.TypeSOA && name == s.baseDomain {
+		resp.Answer = append(resp.Answer, s.soa())
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{s.soa()}
+	}
+	s.logger.WithFields(logrus.Fields{
+		"Client":  w.RemoteAddr().String(),
+		"Name":    question.Name,
+		"Type":    dns.TypeToString[question.Qtype],
+		"Answers": len(resp.Answer),
+	}).Debug("DNS query")
+	w.WriteMsg(resp)
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+var dnsGatewayMetrics = expvar.NewMap("dns_gateway")
+
+// DefaultDNSGatewayAllowCIDRs are the client networks allowed to query the DNS gateway by
+// default: loopback and private networks.
+var DefaultDNSGatewayAllowCIDRs = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// mDNS default TTLs (RFC 6762, section 10), capped by the gateway maximum TTL.
+var dnsGatewayHostTTL = 120 * time.Second
+var dnsGatewayServiceTTL = 75 * time.Minute
+
+// dnsGatewayNegativeTTL is how long negative answers are cached and advertised.
+var dnsGatewayNegativeTTL = 5 * time.Second
+
+var DNSGatewayRecordPTR = "ptr"
+var DNSGatewayRecordSRV = "srv"
+var DNSGatewayRecordTXT = "txt"
+
+type dnsGatewayAnswer struct {
+	rcode   int
+	answer  []dns.RR
+	expires time.Time
+}
+
+type dnsRateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// DNSGateway answers unicast DNS queries for mDNS names (eg: foo.local), for clients which
+// can not use multicast.
+type DNSGateway struct {
+	enabled    bool
+	ifaceName  string
+	mdnsDomain string
+	proto      mdns.Proto
+	browse     func(context.Context, string) ([]mdns.Service, error)
+	hostPolicy *HostPolicy
+	allow      []netip.Prefix
+	maxTTL     time.Duration
+	rateLimit  float64
+	records    map[string]bool
+
+	mutex   sync.Mutex
+	cache   map[string]dnsGatewayAnswer
+	buckets map[netip.Addr]*dnsRateBucket
+}
+
+// NewDNSGateway creates a new DNSGateway.
+//   - allowCIDRs: client networks allowed to query.
+//   - maxTTL: maximum TTL of answers.
+//   - rateLimit: maximum responses per second to each client, 0 for no limit.
+//   - records: record types answered besides A and AAAA (ptr, srv and txt).
+func NewDNSGateway(
+	enabled bool,
+	ifaceName string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostPolicy *HostPolicy,
+	allowCIDRs []string,
+	maxTTL time.Duration,
+	rateLimit float64,
+	records []string,
+) (*DNSGateway, error) {
+	allow, err := parsePrefixes(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	if maxTTL < 0 || rateLimit < 0 {
+		return nil, fmt.Errorf("maximum TTL and rate limit must not be negative")
+	}
+	proto := getProto(disableIPv4, disableIPv6)
+	g := &DNSGateway{
+		enabled:    enabled,
+		ifaceName:  ifaceName,
+		mdnsDomain: mdnsDomain,
+		proto:      proto,
+		browse:     getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostPolicy: hostPolicy,
+		allow:      allow,
+		maxTTL:     maxTTL,
+		rateLimit:  rateLimit,
+		records:    map[string]bool{},
+		cache:      map[string]dnsGatewayAnswer{},
+		buckets:    map[netip.Addr]*dnsRateBucket{},
+	}
+	for _, record := range records {
+		record = strings.ToLower(record)
+		switch record {
+		case DNSGatewayRecordPTR, DNSGatewayRecordSRV, DNSGatewayRecordTXT:
+			g.records[record] = true
+		default:
+			return nil, fmt.Errorf("invalid record type %#v: must be one of %s, %s or %s", record, DNSGatewayRecordPTR, DNSGatewayRecordSRV, DNSGatewayRecordTXT)
+		}
+	}
+	return g, nil
+}
+
+func (g *DNSGateway) allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range g.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// takeToken returns whether a response can be sent to addr, within the rate limit.
+func (g *DNSGateway) takeToken(addr netip.Addr) bool {
+	if g.rateLimit == 0 {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	bucket, ok := g.buckets[addr]
+	if !ok {
+		// Drop buckets of idle clients, which are full anyway
+		if len(g.buckets) > 4096 {
+			for bucketAddr, b := range g.buckets {
+				if now.Sub(b.last).Seconds()*g.rateLimit >= g.rateLimit {
+					delete(g.buckets, bucketAddr)
+				}
+			}
+		}
+		bucket = &dnsRateBucket{tokens: g.rateLimit, last: now}
+		g.buckets[addr] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * g.rateLimit
+	if bucket.tokens > g.rateLimit {
+		bucket.tokens = g.rateLimit
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (g *DNSGateway) ttl(ttl time.Duration) uint32 {
+	if ttl > g.maxTTL {
+		ttl = g.maxTTL
+	}
+	return uint32(ttl.Seconds())
+}
+
+// soa returns the SOA record of the mDNS domain, for negative answers, which are cached
+// for up to ttl.
+func (g *DNSGateway) soa(ttl uint32) dns.RR {
+	zone := dns.Fqdn(g.mdnsDomain)
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
+
+func (g *DNSGateway) getCached(key string) (dnsGatewayAnswer, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	answer, ok := g.cache[key]
+	if !ok || time.Now().After(answer.expires) {
+		delete(g.cache, key)
+		return dnsGatewayAnswer{}, false
+	}
+	return answer, true
+}
+
+func (g *DNSGateway) putCached(key string, answer dnsGatewayAnswer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	for cachedKey, cached := range g.cache {
+		if now.After(cached.expires) {
+			delete(g.cache, cachedKey)
+		}
+	}
+	g.cache[key] = answer
+}
+
+// escapeLabel returns the presentation format of a label with value (eg: "Office Printer").
+func escapeLabel(value string) string {
+	var label strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '.' || c == '\\':
+			label.WriteByte('\\')
+			label.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&label, "\\%03d", c)
+		default:
+			label.WriteByte(c)
+		}
+	}
+	return label.String()
+}
+
+// unescapeLabel returns the value of a presentation format label (eg: "Office\ Printer").
+func unescapeLabel(label string) string {
+	var value strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			value.WriteByte(label[i])
+			continue
+		}
+		if i+3 < len(label) {
+			if code, err := strconv.Atoi(label[i+1 : i+4]); err == nil && code < 256 {
+				value.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		value.WriteByte(label[i+1])
+		i++
+	}
+	return value.String()
+}
+
+// getServices returns the allowed instances of a service type.
+func (g *DNSGateway) getServices(ctx context.Context, serviceType string) ([]mdns.Service, error) {
+	services, err := g.browse(ctx, serviceType)
+	if err != nil {
+		return nil, err
+	}
+	g.hostPolicy.Learn(serviceType, services)
+	allowedServices := []mdns.Service{}
+	for _, service := range services {
+		allowed, err := g.hostPolicy.Allowed(ctx, service.Host, g.browse)
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			allowedServices = append(allowedServices, service)
+		}
+	}
+	sort.SliceStable(allowedServices, func(i, j int) bool {
+		return allowedServices[i].Name < allowedServices[j].Name
+	})
+	return allowedServices, nil
+}
+
+func (g *DNSGateway) resolveHost(ctx context.Context, question dns.Question) (int, []dns.RR, error) {
+	proto := mdns.ProtoInet
+	if question.Qtype == dns.TypeAAAA {
+		proto = mdns.ProtoInet6
+	}
+	if g.proto != mdns.ProtoAny && g.proto != proto {
+		return dns.RcodeSuccess, nil, nil
+	}
+	hostname := strings.TrimSuffix(dns.CanonicalName(question.Name), ".")
+	host, err := resolveMdnsTarget(ctx, hostname, g.ifaceName, g.mdnsDomain, proto, g.hostPolicy, g.browse)
+	if errors.Is(err, errTargetUnresolved) && g.proto == mdns.ProtoAny {
+		// Hosts with addresses of the other family only exist, but have no records of
+		// this type (NODATA)
+		otherProto := mdns.ProtoInet6
+		if proto == mdns.ProtoInet6 {
+			otherProto = mdns.ProtoInet
+		}
+		if _, otherErr := resolveMdnsTarget(
+			ctx, hostname, g.ifaceName, g.mdnsDomain, otherProto, g.hostPolicy, g.browse,
+		); otherErr == nil {
+			return dns.RcodeSuccess, nil, nil
+		}
+	}
+	if err != nil {
+		if errors.Is(err, errTargetNotAllowed) || errors.Is(err, errTargetUnresolved) {
+			return dns.RcodeNameError, nil, nil
+		}
+		return dns.RcodeServerFailure, nil, err
+	}
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    g.ttl(dnsGatewayHostTTL),
+	}
+	switch {
+	case question.Qtype == dns.TypeA && host.IP.To4() != nil:
+		return dns.RcodeSuccess, []dns.RR{&dns.A{Hdr: header, A: host.IP.To4()}}, nil
+	// Link-local addresses are useless for clients on other networks
+	case question.Qtype == dns.TypeAAAA && host.IP.To4() == nil && !host.IP.IsLinkLocalUnicast():
+		return dns.RcodeSuccess, []dns.RR{&dns.AAAA{Hdr: header, AAAA: host.IP}}, nil
+	}
+	return dns.RcodeSuccess, nil, nil
+}
+
+func (g *DNSGateway) resolveService(ctx context.Context, question dns.Question) (int, []dns.RR, error) {
+	labels := dns.SplitDomainName(question.Name)
+	switch question.Qtype {
+	case dns.TypePTR:
+		// _type._proto.local
+		if !g.records[DNSGatewayRecordPTR] || len(labels) != 3 {
+			return dns.RcodeSuccess, nil, nil
+		}
+		services, err := g.getServices(ctx, strings.Join(labels[:2], "."))
+		if err != nil {
+			return dns.RcodeServerFailure, nil, err
+		}
+		answer := []dns.RR{}
+		seen := map[string]bool{}
+		for _, service := range services {
+			instance := fmt.Sprintf("%s.%s", escapeLabel(service.Name), dns.Fqdn(question.Name))
+			if seen[instance] {
+				continue
+			}
+			seen[instance] = true
+			answer = append(answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: g.ttl(dnsGatewayServiceTTL)},
+				Ptr: instance,
+			})
+		}
+		if len(answer) == 0 {
+			return dns.RcodeNameError, nil, nil
+		}
+		return dns.RcodeSuccess, answer, nil
+	case dns.TypeSRV, dns.TypeTXT:
+		// instance._type._proto.local
+		if (question.Qtype == dns.TypeSRV && !g.records[DNSGatewayRecordSRV]) ||
+			(question.Qtype == dns.TypeTXT && !g.records[DNSGatewayRecordTXT]) ||
+			len(labels) != 4 {
+			return dns.RcodeSuccess, nil, nil
+		}
+		services, err := g.getServices(ctx, strings.Join(labels[1:3], "."))
+		if err != nil {
+			return dns.RcodeServerFailure, nil, err
+		}
+		name := unescapeLabel(labels[0])
+		for _, service := range services {
+			if !strings.EqualFold(service.Name, name) {
+				continue
+			}
+			header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: g.ttl(dnsGatewayHostTTL)}
+			if question.Qtype == dns.TypeSRV {
+				return dns.RcodeSuccess, []dns.RR{&dns.SRV{
+					Hdr:    header,
+					Target: dns.Fqdn(service.Host),
+					Port:   service.Port,
+				}}, nil
+			}
+			header.Ttl = g.ttl(dnsGatewayServiceTTL)
+			txt := []string{}
+			for key, value := range service.Txt {
+				txt = append(txt, fmt.Sprintf("%s=%s", key, value))
+			}
+			sort.Strings(txt)
+			if len(txt) == 0 {
+				txt = []string{""}
+			}
+			return dns.RcodeSuccess, []dns.RR{&dns.TXT{Hdr: header, Txt: txt}}, nil
+		}
+		return dns.RcodeNameError, nil, nil
+	}
+	return dns.RcodeSuccess, nil, nil
+}
+
+func (g *DNSGateway) resolve(ctx context.Context, question dns.Question) (int, []dns.RR, error) {
+	labels := dns.SplitDomainName(question.Name)
+	if len(labels) > 2 && strings.HasPrefix(labels[len(labels)-2], "_") {
+		return g.resolveService(ctx, question)
+	}
+	if len(labels) != 2 {
+		return dns.RcodeNameError, nil, nil
+	}
+	switch question.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return g.resolveHost(ctx, question)
+	}
+	return dns.RcodeSuccess, nil, nil
+}
+
+func (g *DNSGateway) serve(ctx context.Context, logger *logrus.Logger, w dns.ResponseWriter, req *dns.Msg) {
+	var client netip.Addr
+	if addrPort, err := netip.ParseAddrPort(w.RemoteAddr().String()); err == nil {
+		client = addrPort.Addr()
+	}
+	resp := new(dns.Msg)
+	if !g.allowed(client) {
+		dnsGatewayMetrics.Add("refused", 1)
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return
+	}
+	if !g.takeToken(client.Unmap()) {
+		dnsGatewayMetrics.Add("rate_limited", 1)
+		return
+	}
+	dnsGatewayMetrics.Add("queries", 1)
+	resp.SetReply(req)
+	if len(req.Question) != 1 {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(resp)
+		return
+	}
+	question := req.Question[0]
+	key := fmt.Sprintf("%s/%d", dns.CanonicalName(question.Name), question.Qtype)
+
+	answer, ok := g.getCached(key)
+	if !ok {
+		rcode, rrs, err := g.resolve(ctx, question)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"Client": w.RemoteAddr().String(),
+				"Name":   question.Name,
+				"Type":   dns.TypeToString[question.Qtype],
+			}).Warnf("DNS gateway query failed: %v", err)
+		}
+		ttl := dnsGatewayNegativeTTL
+		for i, rr := range rrs {
+			if rrTTL := time.Duration(rr.Header().Ttl) * time.Second; i == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+		}
+		answer = dnsGatewayAnswer{
+			rcode:   rcode,
+			answer:  rrs,
+			expires: time.Now().Add(ttl),
+		}
+		if rcode != dns.RcodeServerFailure {
+			g.putCached(key, answer)
+		}
+	}
+	resp.Rcode = answer.rcode
+	// Cached answers are sent with their remaining TTL
+	remaining := uint32(time.Until(answer.expires).Round(time.Second).Seconds())
+	for _, rr := range answer.answer {
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		if rr.Header().Ttl > remaining {
+			rr.Header().Ttl = remaining
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	if len(resp.Answer) == 0 && (resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError) {
+		ttl := g.ttl(dnsGatewayNegativeTTL)
+		if ttl > remaining {
+			ttl = remaining
+		}
+		resp.Ns = []dns.RR{g.soa(ttl)}
+	}
+	logger.WithFields(logrus.Fields{
+		"Client":  w.RemoteAddr().String(),
+		"Name":    question.Name,
+		"Type":    dns.TypeToString[question.Qtype],
+		"Answers": len(resp.Answer),
+		"Cached":  ok,
+	}).Debug("DNS gateway query")
+	w.WriteMsg(resp)
+}
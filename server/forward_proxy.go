@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// ForwardProxy is a standard HTTP proxy (absolute-URI requests and CONNECT) which only
+// allows mDNS hosts as targets.
+type ForwardProxy struct {
+	enabled     bool
+	ifaceName   string
+	mdnsDomain  string
+	proto       mdns.Proto
+	browse      func(context.Context, string) ([]mdns.Service, error)
+	hostPolicy  *HostPolicy
+	proxy       *Proxy
+	streams     *Streams
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// resolveTarget checks that a target host name is an allowed mDNS host, and resolves it.
+	resolveTarget func(ctx context.Context, hostname string) (mdns.Host, error)
+}
+
+// NewForwardProxy creates a new ForwardProxy. HTTP requests are proxied with proxy, and
+// CONNECT tunnels are limited by streams.
+func NewForwardProxy(
+	enabled bool,
+	ifaceName string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostPolicy *HostPolicy,
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	dialTimeout time.Duration,
+	proxy *Proxy,
+	streams *Streams,
+) *ForwardProxy {
+	proto := getProto(disableIPv4, disableIPv6)
+	f := &ForwardProxy{
+		enabled:     enabled,
+		ifaceName:   ifaceName,
+		mdnsDomain:  mdnsDomain,
+		proto:       proto,
+		browse:      getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostPolicy:  hostPolicy,
+		proxy:       proxy,
+		streams:     streams,
+		dialContext: newUpstreamDialContext(upstreamPolicy, upstreamBinder, dialTimeout),
+	}
+	f.resolveTarget = func(ctx context.Context, hostname string) (mdns.Host, error) {
+		return resolveMdnsTarget(ctx, hostname, f.ifaceName, f.mdnsDomain, f.proto, f.hostPolicy, f.browse)
+	}
+	return f
+}
+
+// Handles returns whether req is a forward proxy request to be served by ServeHTTP.
+func (f *ForwardProxy) Handles(req *http.Request) bool {
+	return f.enabled && (req.Method == http.MethodConnect || req.URL.IsAbs())
+}
+
+// resolve checks that hostname is an allowed mDNS host, and resolves it.
+func (f *ForwardProxy) resolve(ctx context.Context, hostname string) (mdns.Host, int, error) {
+	host, err := f.resolveTarget(ctx, hostname)
+	if err != nil {
+		switch {
+		case errors.Is(err, errTargetNotAllowed):
+			return mdns.Host{}, http.StatusForbidden, err
+		case errors.Is(err, errTargetUnresolved):
+			return mdns.Host{}, http.StatusBadGateway, err
+		default:
+			return mdns.Host{}, http.StatusInternalServerError, err
+		}
+	}
+	return host, 0, nil
+}
+
+func getTargetPort(u *url.URL, defaultPort uint16) (uint16, error) {
+	if u.Port() == "" {
+		return defaultPort, nil
+	}
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port: %#v", u.Port())
+	}
+	return uint16(port), nil
+}
+
+// ServeHTTP serves a forward proxy request.
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method == http.MethodConnect {
+		f.serveConnect(ctx, w, req)
+		return
+	}
+
+	if req.URL.Scheme != "http" {
+		http.Error(w, fmt.Sprintf("Bad request: unsupported scheme: %s", req.URL.Scheme), http.StatusBadRequest)
+		return
+	}
+	port, err := getTargetPort(req.URL, 80)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad request: %v", err), http.StatusBadRequest)
+		return
+	}
+	host, status, err := f.resolve(ctx, req.URL.Hostname())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(status), err), status)
+		return
+	}
+	req.Host = req.URL.Host
+	// Clients address mDNS hosts directly, so responses are not rewritten
+	f.proxy.ServeHTTP(w, req, host, port, func(string) *url.URL { return nil })
+}
+
+func (f *ForwardProxy) serveConnect(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"Client": req.RemoteAddr,
+		"Target": req.URL.Host,
+	})
+	if req.ProtoMajor != 1 {
+		http.Error(w, "CONNECT is only supported with HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	port, err := getTargetPort(req.URL, 0)
+	if err != nil || port == 0 {
+		http.Error(w, "Bad request: CONNECT target must be in the format host:port", http.StatusBadRequest)
+		return
+	}
+	host, status, err := f.resolve(ctx, req.URL.Hostname())
+	if err != nil {
+		logger.Warnf("CONNECT refused: %v", err)
+		http.Error(w, fmt.Sprintf("%s: %v", http.StatusText(status), err), status)
+		return
+	}
+
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	release, err := f.streams.Acquire("connect", client, host.Name)
+	if err != nil {
+		logger.Warnf("CONNECT refused: %v", err)
+		http.Error(w, fmt.Sprintf("Too many requests: %v", err), http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	upstreamConn, err := f.dialContext(
+		withUpstreamInterface(ctx, host.Interface), "tcp", host.HostPort(port),
+	)
+	if err != nil {
+		logger.Errorf("Error connecting to target: %v", err)
+		http.Error(w, fmt.Sprintf("Error connecting to '%s': %v", req.URL.Host, err), http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.Errorf("Error hijacking connection: %v", err)
+		http.Error(w, fmt.Sprintf("Error hijacking connection: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	// Data sent by the client right after the request may already be buffered
+	clientConn := net.Conn(conn)
+	if n := buf.Reader.Buffered(); n > 0 {
+		buffered, _ := buf.Reader.Peek(n)
+		clientConn = &prefixedConn{
+			Conn:   conn,
+			reader: io.MultiReader(bytes.NewReader(buffered), conn),
+		}
+	}
+
+	start := time.Now()
+	logger = logger.WithField("Upstream", upstreamConn.RemoteAddr().String())
+	logger.Info("CONNECT tunnel opened")
+	sent, received := splice(f.streams.WrapConn(clientConn), f.streams.WrapConn(upstreamConn))
+	logger.WithFields(logrus.Fields{
+		"Duration": time.Since(start).String(),
+		"Sent":     sent,
+		"Received": received,
+	}).Info("CONNECT tunnel closed")
+}
+
+// ServePAC serves a proxy auto-config file, which uses this proxy for mDNS hosts only.
+func (f *ForwardProxy) ServePAC(w http.ResponseWriter, req *http.Request) {
+	scheme := getScheme(req)
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+	directive := "PROXY"
+	if scheme == "https" {
+		directive = "HTTPS"
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, `function FindProxyForURL(url, host) {
+	if (dnsDomainIs(host, ".%s")) {
+		return "%s %s";
+	}
+	return "DIRECT";
+}
+`, f.mdnsDomain, directive, host)
+}
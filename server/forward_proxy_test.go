@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+func TestForwardProxyNonDefaultPort(t *testing.T) {
+	upstreamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Host)
+	}))
+	defer upstreamServer.Close()
+	_, port, err := net.SplitHostPort(upstreamServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamPolicy, err := NewUpstreamPolicy([]string{"127.0.0.0/8"}, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamBinder, err := NewUpstreamBinder(UpstreamBindNone, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := NewLimiter("local", 0, 0, time.Second, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewCache(false, "local", 0, 0, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams := NewStreams(0, 0, time.Minute, time.Minute)
+	proxy := NewProxy(
+		upstreamPolicy, upstreamBinder, limiter, NewBodyRewriter("local", nil, nil), streams, cache,
+		0, time.Second, time.Minute, time.Minute, 0, 0,
+	)
+	defer proxy.Close()
+	forwardProxy := NewForwardProxy(
+		true, mdns.AnyIface, "local", time.Second, false, false, nil,
+		upstreamPolicy, upstreamBinder, time.Second, proxy, streams,
+	)
+	forwardProxy.resolveTarget = func(ctx context.Context, hostname string) (mdns.Host, error) {
+		return mdns.Host{Name: hostname, IP: net.IPv4(127, 0, 0, 1)}, nil
+	}
+
+	ctx := log.SetLoggerValue(context.Background(), io.Discard, "error", nil)
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://foo.local:%s/x", port), nil)
+	req = req.WithContext(ctx)
+	if !forwardProxy.Handles(req) {
+		t.Fatal("absolute-URI request not handled")
+	}
+	recorder := httptest.NewRecorder()
+	forwardProxy.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, recorder.Code, recorder.Body.String())
+	}
+	if expected := net.JoinHostPort("foo.local", port); recorder.Body.String() != expected {
+		t.Fatalf("expected upstream Host %#v, got %#v", expected, recorder.Body.String())
+	}
+}
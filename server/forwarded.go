@@ -0,0 +1,311 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+type forwardedKeyType string
+
+var forwardedKey = forwardedKeyType("forwarded")
+
+// forwardedInfo holds information about the original client request, as seen by the first
+// trusted hop.
+type forwardedInfo struct {
+	// scheme used by the client.
+	scheme string
+	// host requested by the client, which may include a port.
+	host string
+	// forwardedFor is the chain of addresses which the request went through, starting at
+	// the client and ending at the proxy peer.
+	forwardedFor []string
+	// elements are the Forwarded header elements to pass upstream, excluding the one for
+	// this proxy.
+	elements []string
+}
+
+func getForwardedInfo(req *http.Request) (forwardedInfo, bool) {
+	info, ok := req.Context().Value(forwardedKey).(forwardedInfo)
+	return info, ok
+}
+
+// TrustedProxies defines the proxies from which forwarding headers (Forwarded,
+// X-Forwarded-*, X-Real-IP) are honored. Forwarding headers from other peers are
+// ignored and overwritten.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// NewTrustedProxies creates TrustedProxies for peers within the given networks.
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+func parseAddr(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func (t *TrustedProxies) isTrusted(value string) bool {
+	addr, ok := parseAddr(value)
+	if !ok {
+		return false
+	}
+	for _, prefix := range t.prefixes {
+		if prefix.Contains(addr.WithZone("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitQuoted splits s at sep, except when within a quoted string.
+func splitQuoted(s string, sep rune) []string {
+	parts := []string{}
+	var quoted bool
+	var start int
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+type forwardedElement struct {
+	raw    string
+	params map[string]string
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values.
+func parseForwarded(values []string) []forwardedElement {
+	elements := []forwardedElement{}
+	for _, value := range values {
+		for _, raw := range splitQuoted(value, ',') {
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			element := forwardedElement{
+				raw:    raw,
+				params: map[string]string{},
+			}
+			for _, pair := range splitQuoted(raw, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+				element.params[strings.ToLower(key)] = value
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+func splitHeaderList(values []string) []string {
+	list := []string{}
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func formatForwardedNode(addr string) string {
+	if ip, ok := parseAddr(addr); ok {
+		if ip.Is6() {
+			return fmt.Sprintf(`"[%s]"`, ip)
+		}
+		return ip.String()
+	}
+	return strconv.Quote(addr)
+}
+
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"X-Scheme",
+}
+
+// Apply returns a copy of the request with its Host and RemoteAddr set from the forwarding
+// headers, if the peer is trusted. Forwarding headers are always removed.
+func (t *TrustedProxies) Apply(req *http.Request) *http.Request {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+
+	info := forwardedInfo{
+		scheme:       "http",
+		host:         req.Host,
+		forwardedFor: []string{peer},
+		elements:     []string{},
+	}
+	if req.TLS != nil {
+		info.scheme = "https"
+	}
+
+	if t.isTrusted(peer) {
+		t.applyTrusted(req, &info)
+	}
+
+	req = req.Clone(context.WithValue(req.Context(), forwardedKey, info))
+	for _, header := range forwardingHeaders {
+		req.Header.Del(header)
+	}
+	req.Host = info.host
+	if len(info.forwardedFor) > 1 {
+		// The client port is unknown
+		req.RemoteAddr = net.JoinHostPort(info.forwardedFor[0], "0")
+	}
+	return req
+}
+
+func (t *TrustedProxies) applyTrusted(req *http.Request, info *forwardedInfo) {
+	peer := info.forwardedFor[0]
+
+	if elements := parseForwarded(req.Header.Values("Forwarded")); len(elements) > 0 {
+		idx := len(elements) - 1
+		for idx > 0 && t.isTrusted(elements[idx].params["for"]) {
+			idx--
+		}
+		client := elements[idx]
+		forwardedFor := []string{}
+		for _, element := range elements[idx:] {
+			if addr, ok := parseAddr(element.params["for"]); ok {
+				forwardedFor = append(forwardedFor, addr.String())
+			} else {
+				forwardedFor = append(forwardedFor, element.params["for"])
+			}
+			info.elements = append(info.elements, element.raw)
+		}
+		info.forwardedFor = append(forwardedFor, peer)
+		last := elements[len(elements)-1]
+		for _, element := range []forwardedElement{client, last} {
+			if proto, ok := element.params["proto"]; ok {
+				info.scheme = strings.ToLower(proto)
+				break
+			}
+		}
+		for _, element := range []forwardedElement{client, last} {
+			if host, ok := element.params["host"]; ok {
+				info.host = host
+				break
+			}
+		}
+		return
+	}
+
+	if forwardedFor := splitHeaderList(req.Header.Values("X-Forwarded-For")); len(forwardedFor) > 0 {
+		idx := len(forwardedFor) - 1
+		for idx > 0 && t.isTrusted(forwardedFor[idx]) {
+			idx--
+		}
+		info.forwardedFor = append(forwardedFor[idx:], peer)
+	} else if realIP := strings.TrimSpace(req.Header.Get("X-Real-Ip")); realIP != "" {
+		info.forwardedFor = []string{realIP, peer}
+	}
+	for i, forwardedFor := range info.forwardedFor {
+		if addr, ok := parseAddr(forwardedFor); ok {
+			info.forwardedFor[i] = addr.String()
+		}
+	}
+
+	if proto := splitHeaderList(req.Header.Values("X-Forwarded-Proto")); len(proto) > 0 {
+		info.scheme = strings.ToLower(proto[0])
+	} else if scheme := req.Header.Get("X-Scheme"); scheme != "" {
+		info.scheme = strings.ToLower(scheme)
+	}
+
+	if host := splitHeaderList(req.Header.Values("X-Forwarded-Host")); len(host) > 0 {
+		info.host = host[0]
+	}
+
+	if port := splitHeaderList(req.Header.Values("X-Forwarded-Port")); len(port) > 0 {
+		if _, err := strconv.ParseUint(port[0], 10, 16); err == nil {
+			host, _, err := net.SplitHostPort(info.host)
+			if err != nil {
+				host = info.host
+			}
+			info.host = net.JoinHostPort(strings.Trim(host, "[]"), port[0])
+		}
+	}
+}
+
+// setForwardedHeaders sets forwarding headers for the upstream request.
+func setForwardedHeaders(pr *httputil.ProxyRequest) {
+	for _, header := range forwardingHeaders {
+		pr.Out.Header.Del(header)
+	}
+
+	info, ok := getForwardedInfo(pr.In)
+	if !ok {
+		pr.SetXForwarded()
+		return
+	}
+
+	_, port, err := net.SplitHostPort(info.host)
+	if err != nil {
+		port = "80"
+		if info.scheme == "https" {
+			port = "443"
+		}
+	}
+
+	pr.Out.Header.Set("X-Forwarded-For", strings.Join(info.forwardedFor, ", "))
+	pr.Out.Header.Set("X-Forwarded-Host", info.host)
+	pr.Out.Header.Set("X-Forwarded-Port", port)
+	pr.Out.Header.Set("X-Forwarded-Proto", info.scheme)
+	pr.Out.Header.Set("X-Real-Ip", info.forwardedFor[0])
+
+	elements := info.elements
+	if len(elements) == 0 {
+		for _, forwardedFor := range info.forwardedFor[:len(info.forwardedFor)-1] {
+			elements = append(elements, fmt.Sprintf("for=%s", formatForwardedNode(forwardedFor)))
+		}
+	}
+	elements = append(elements, fmt.Sprintf(
+		"for=%s;host=%s;proto=%s",
+		formatForwardedNode(info.forwardedFor[len(info.forwardedFor)-1]),
+		strconv.Quote(info.host),
+		info.scheme,
+	))
+	pr.Out.Header.Set("Forwarded", strings.Join(elements, ", "))
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+type hostRuleKind int
+
+const (
+	hostRuleName hostRuleKind = iota
+	hostRuleService
+	hostRuleTxt
+)
+
+type hostRule struct {
+	kind     hostRuleKind
+	pattern  string
+	txtKey   string
+	txtValue *string
+}
+
+func newHostRule(rule string) (hostRule, error) {
+	kind, value, ok := strings.Cut(rule, ":")
+	if !ok {
+		kind, value = "host", rule
+	}
+	if value == "" {
+		return hostRule{}, fmt.Errorf("invalid rule %#v: empty value", rule)
+	}
+	switch kind {
+	case "host":
+		if _, err := path.Match(value, ""); err != nil {
+			return hostRule{}, fmt.Errorf("invalid rule %#v: %w", rule, err)
+		}
+		return hostRule{kind: hostRuleName, pattern: strings.ToLower(value)}, nil
+	case "service":
+		return hostRule{kind: hostRuleService, pattern: value}, nil
+	case "txt":
+		key, txtValue, hasValue := strings.Cut(value, "=")
+		r := hostRule{kind: hostRuleTxt, txtKey: strings.ToLower(key)}
+		if hasValue {
+			if _, err := path.Match(txtValue, ""); err != nil {
+				return hostRule{}, fmt.Errorf("invalid rule %#v: %w", rule, err)
+			}
+			r.txtValue = &txtValue
+		}
+		return r, nil
+	default:
+		return hostRule{}, fmt.Errorf("invalid rule %#v: unknown kind %#v", rule, kind)
+	}
+}
+
+func (r hostRule) match(host, label string, services []mdns.Service) bool {
+	switch r.kind {
+	case hostRuleName:
+		for _, name := range []string{host, label} {
+			if ok, _ := path.Match(r.pattern, name); ok {
+				return true
+			}
+		}
+	case hostRuleService:
+		for _, service := range services {
+			if service.Type == r.pattern {
+				return true
+			}
+		}
+	case hostRuleTxt:
+		for _, service := range services {
+			value, ok := service.Txt[r.txtKey]
+			if !ok {
+				continue
+			}
+			if r.txtValue == nil {
+				return true
+			}
+			if ok, _ := path.Match(*r.txtValue, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type browsedServices struct {
+	services []mdns.Service
+	time     time.Time
+}
+
+// HostPolicy defines which mDNS hosts the proxy is allowed to reach.
+//
+// Rules can be in the formats:
+//   - host:<glob> or <glob>: host name glob (eg: esp32-*.local).
+//   - service:<type>: hosts offering the given service type (eg: _esphomelib._tcp).
+//   - txt:<key>[=<glob>]: hosts with services having the given TXT key, optionally
+//     matching the given value glob.
+//
+// A host is allowed if it matches no deny rule and, when allow rules are set, it
+// matches at least one of them.
+type HostPolicy struct {
+	mdnsDomain  string
+	service     string
+	allowRules  []hostRule
+	denyRules   []hostRule
+	cacheTTL    time.Duration
+	mutex       sync.Mutex
+	browseCache map[string]browsedServices
+}
+
+// NewHostPolicy creates a new HostPolicy. Services used by service and TXT rules
+// are browsed for the configured service type, plus all types referenced by rules,
+// and cached for cacheTTL.
+func NewHostPolicy(
+	mdnsDomain string,
+	service string,
+	allow []string,
+	deny []string,
+	cacheTTL time.Duration,
+) (*HostPolicy, error) {
+	p := &HostPolicy{
+		mdnsDomain:  mdnsDomain,
+		service:     service,
+		cacheTTL:    cacheTTL,
+		browseCache: map[string]browsedServices{},
+	}
+	for _, rule := range allow {
+		r, err := newHostRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.allowRules = append(p.allowRules, r)
+	}
+	for _, rule := range deny {
+		r, err := newHostRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		p.denyRules = append(p.denyRules, r)
+	}
+	return p, nil
+}
+
+func (p *HostPolicy) serviceTypes() []string {
+	var needServices bool
+	serviceTypes := []string{}
+	seen := map[string]bool{}
+	for _, r := range append(append([]hostRule{}, p.allowRules...), p.denyRules...) {
+		switch r.kind {
+		case hostRuleService:
+			needServices = true
+			if !seen[r.pattern] {
+				serviceTypes = append(serviceTypes, r.pattern)
+				seen[r.pattern] = true
+			}
+		case hostRuleTxt:
+			needServices = true
+		}
+	}
+	if !needServices {
+		return nil
+	}
+	if !seen[p.service] {
+		serviceTypes = append(serviceTypes, p.service)
+	}
+	return serviceTypes
+}
+
+// Learn caches services browsed elsewhere, so they can be reused for rule matching.
+func (p *HostPolicy) Learn(serviceType string, services []mdns.Service) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.browseCache[serviceType] = browsedServices{
+		services: services,
+		time:     time.Now(),
+	}
+}
+
+func (p *HostPolicy) getServices(
+	ctx context.Context,
+	serviceType string,
+	browse func(context.Context, string) ([]mdns.Service, error),
+) ([]mdns.Service, error) {
+	p.mutex.Lock()
+	cached, ok := p.browseCache[serviceType]
+	p.mutex.Unlock()
+	if ok && time.Since(cached.time) < p.cacheTTL {
+		return cached.services, nil
+	}
+	services, err := browse(ctx, serviceType)
+	if err != nil {
+		return nil, err
+	}
+	p.Learn(serviceType, services)
+	return services, nil
+}
+
+// Allowed returns whether the given mDNS host (eg: foo.local) can be reached. browse is
+// only called when rules depend on service information which is not cached.
+func (p *HostPolicy) Allowed(
+	ctx context.Context,
+	host string,
+	browse func(ctx context.Context, serviceType string) ([]mdns.Service, error),
+) (bool, error) {
+	host = strings.ToLower(host)
+	label := strings.TrimSuffix(host, fmt.Sprintf(".%s", p.mdnsDomain))
+
+	var hostServices []mdns.Service
+	for _, serviceType := range p.serviceTypes() {
+		services, err := p.getServices(ctx, serviceType, browse)
+		if err != nil {
+			return false, err
+		}
+		for _, service := range services {
+			if strings.ToLower(service.Host) == host {
+				hostServices = append(hostServices, service)
+			}
+		}
+	}
+
+	for _, r := range p.denyRules {
+		if r.match(host, label, hostServices) {
+			return false, nil
+		}
+	}
+	if len(p.allowRules) == 0 {
+		return true, nil
+	}
+	for _, r := range p.allowRules {
+		if r.match(host, label, hostServices) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+func TestHostPolicyAllowed(t *testing.T) {
+	services := map[string][]mdns.Service{
+		"_http._tcp": {
+			{Name: "Printer", Type: "_http._tcp", Host: "printer.local", Txt: map[string]string{"model": "laser-100"}},
+			{Name: "Camera", Type: "_http._tcp", Host: "camera.local", Txt: map[string]string{}},
+			{Name: "Node", Type: "_http._tcp", Host: "esp32-a1b2c3.local", Txt: map[string]string{}},
+		},
+		"_esphomelib._tcp": {
+			{Name: "Node", Type: "_esphomelib._tcp", Host: "esp32-a1b2c3.local"},
+		},
+	}
+	browse := func(ctx context.Context, serviceType string) ([]mdns.Service, error) {
+		return services[serviceType], nil
+	}
+
+	for _, tc := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		host    string
+		allowed bool
+	}{
+		{name: "no rules", host: "camera.local", allowed: true},
+		{name: "allowed glob", allow: []string{"esp32-*"}, host: "esp32-a1b2c3.local", allowed: true},
+		{name: "allowed glob with domain", allow: []string{"host:esp32-*.local"}, host: "ESP32-A1B2C3.local", allowed: true},
+		{name: "not allowed", allow: []string{"esp32-*"}, host: "camera.local"},
+		{name: "denied", deny: []string{"camera"}, host: "camera.local"},
+		{name: "deny over allow", allow: []string{"*"}, deny: []string{"camera"}, host: "camera.local"},
+		{name: "allowed service", allow: []string{"service:_esphomelib._tcp"}, host: "esp32-a1b2c3.local", allowed: true},
+		{name: "missing service", allow: []string{"service:_esphomelib._tcp"}, host: "printer.local"},
+		{name: "allowed TXT key", allow: []string{"txt:model"}, host: "printer.local", allowed: true},
+		{name: "allowed TXT value", allow: []string{"txt:model=laser-*"}, host: "printer.local", allowed: true},
+		{name: "other TXT value", allow: []string{"txt:model=inkjet-*"}, host: "printer.local"},
+		{name: "denied TXT key", deny: []string{"txt:model"}, host: "printer.local"},
+		{name: "unknown host with service rule", allow: []string{"service:_http._tcp"}, host: "unknown.local"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := NewHostPolicy("local", "_http._tcp", tc.allow, tc.deny, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed, err := policy.Allowed(context.Background(), tc.host, browse)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != tc.allowed {
+				t.Fatalf("expected allowed %v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errLimiterQueueFull = errors.New("too many queued requests")
+var errLimiterQueueTimeout = errors.New("timeout waiting in queue")
+
+type hostLimiter struct {
+	slots    chan struct{}
+	maxQueue int
+	queued   int
+}
+
+// Limiter limits the number of in-flight requests to each upstream host. Requests
+// above the limit are queued up to a limit, and wait for a bounded time.
+type Limiter struct {
+	mdnsDomain      string
+	maxInFlight     int
+	maxQueue        int
+	queueTimeout    time.Duration
+	hostMaxInFlight map[string]int
+	hostMaxQueue    map[string]int
+
+	mutex sync.Mutex
+	hosts map[string]*hostLimiter
+}
+
+// NewLimiter creates a new Limiter.
+//   - maxInFlight: maximum number of in-flight requests to each host, 0 for no limit.
+//   - maxQueue: maximum number of requests waiting for each host.
+//   - queueTimeout: maximum time a request waits in queue.
+//   - hostMaxInFlight, hostMaxQueue: per host overrides, keyed by mDNS host.
+func NewLimiter(
+	mdnsDomain string,
+	maxInFlight int,
+	maxQueue int,
+	queueTimeout time.Duration,
+	hostMaxInFlight map[string]int,
+	hostMaxQueue map[string]int,
+) (*Limiter, error) {
+	l := &Limiter{
+		mdnsDomain:      mdnsDomain,
+		maxInFlight:     maxInFlight,
+		maxQueue:        maxQueue,
+		queueTimeout:    queueTimeout,
+		hostMaxInFlight: map[string]int{},
+		hostMaxQueue:    map[string]int{},
+		hosts:           map[string]*hostLimiter{},
+	}
+	if maxInFlight < 0 || maxQueue < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+	for host, value := range hostMaxInFlight {
+		if value < 0 {
+			return nil, fmt.Errorf("invalid limit for host %#v: must not be negative", host)
+		}
+		l.hostMaxInFlight[l.trimMdnsDomain(host)] = value
+	}
+	for host, value := range hostMaxQueue {
+		if value < 0 {
+			return nil, fmt.Errorf("invalid queue limit for host %#v: must not be negative", host)
+		}
+		l.hostMaxQueue[l.trimMdnsDomain(host)] = value
+	}
+	return l, nil
+}
+
+func (l *Limiter) trimMdnsDomain(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), fmt.Sprintf(".%s", l.mdnsDomain))
+}
+
+func (l *Limiter) getHostLimiter(host string) *hostLimiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if h, ok := l.hosts[host]; ok {
+		return h
+	}
+	maxInFlight := l.maxInFlight
+	if value, ok := l.hostMaxInFlight[host]; ok {
+		maxInFlight = value
+	}
+	maxQueue := l.maxQueue
+	if value, ok := l.hostMaxQueue[host]; ok {
+		maxQueue = value
+	}
+	var h *hostLimiter
+	if maxInFlight > 0 {
+		h = &hostLimiter{
+			slots:    make(chan struct{}, maxInFlight),
+			maxQueue: maxQueue,
+		}
+	}
+	l.hosts[host] = h
+	return h
+}
+
+// RetryAfter is the suggested delay for clients to retry requests refused by Acquire.
+func (l *Limiter) RetryAfter() time.Duration {
+	if l.queueTimeout < time.Second {
+		return time.Second
+	}
+	return l.queueTimeout
+}
+
+// Acquire waits for a slot to make a request to the given mDNS host. On success, release
+// must be called once the request is done.
+func (l *Limiter) Acquire(ctx context.Context, host string) (release func(), err error) {
+	h := l.getHostLimiter(l.trimMdnsDomain(host))
+	if h == nil {
+		return func() {}, nil
+	}
+	release = func() { <-h.slots }
+
+	select {
+	case h.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	l.mutex.Lock()
+	if h.queued >= h.maxQueue {
+		l.mutex.Unlock()
+		return nil, errLimiterQueueFull
+	}
+	h.queued++
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		h.queued--
+		l.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case h.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errLimiterQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
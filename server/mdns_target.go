@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+var errTargetNotAllowed = errors.New("target not allowed")
+var errTargetUnresolved = errors.New("target not resolved")
+
+// resolveMdnsTarget checks that hostname, as given by a client, is an allowed mDNS host,
+// and resolves it.
+func resolveMdnsTarget(
+	ctx context.Context,
+	hostname string,
+	ifaceName string,
+	mdnsDomain string,
+	proto mdns.Proto,
+	hostPolicy *HostPolicy,
+	browse func(context.Context, string) ([]mdns.Service, error),
+) (mdns.Host, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	label, ok := strings.CutSuffix(hostname, fmt.Sprintf(".%s", mdnsDomain))
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return mdns.Host{}, fmt.Errorf("%w: only %s hosts can be proxied, got: %s", errTargetNotAllowed, mdnsDomain, hostname)
+	}
+	allowed, err := hostPolicy.Allowed(ctx, hostname, browse)
+	if err != nil {
+		return mdns.Host{}, fmt.Errorf("error checking host policy for '%s': %v", hostname, err)
+	}
+	if !allowed {
+		return mdns.Host{}, fmt.Errorf("%w: host %s is not allowed", errTargetNotAllowed, hostname)
+	}
+	m, err := mdns.NewMDNS()
+	if err != nil {
+		return mdns.Host{}, fmt.Errorf("error getting mDNS client: %v", err)
+	}
+	defer m.Close()
+	host, err := m.ResolveHost(hostname, ifaceName, proto)
+	if err != nil {
+		return mdns.Host{}, fmt.Errorf("%w: error resolving host '%s': %v", errTargetUnresolved, hostname, err)
+	}
+	return host, nil
+}
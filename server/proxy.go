@@ -0,0 +1,336 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (b *bufferPool) Get() []byte {
+	return *b.pool.Get().(*[]byte)
+}
+
+func (b *bufferPool) Put(buf []byte) {
+	b.pool.Put(&buf)
+}
+
+type upstreamKeyType string
+
+var upstreamKey = upstreamKeyType("upstream")
+
+type upstream struct {
+	url       *url.URL
+	host      string
+	ip        net.IP
+	port      uint16
+	publicURL func(host string) *url.URL
+	// pathPrefix is the public path prefix of the upstream host, without a trailing slash.
+	pathPrefix string
+}
+
+type streamKeyType string
+
+var streamKey = streamKeyType("stream")
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newUpstreamDialContext returns a function to connect to upstream hosts, enforcing
+// the upstream policy and binding.
+func newUpstreamDialContext(
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	dialTimeout time.Duration,
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialer := &net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   upstreamPolicy.Control,
+		}
+		if err := upstreamBinder.Configure(ctx, dialer, address); err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
+
+// Proxy is a long-lived reverse proxy to mDNS hosts. All upstream connections share
+// the same pooled transport, except for long-lived streams, which use dedicated
+// connections.
+type Proxy struct {
+	transport       *http.Transport
+	streamTransport *http.Transport
+	reverseProxy    *httputil.ReverseProxy
+	limiter         *Limiter
+	bodyRewriter    *BodyRewriter
+	streams         *Streams
+	cache           *Cache
+}
+
+// NewProxy creates a new Proxy.
+//   - dialTimeout: timeout for connecting to upstream hosts.
+//   - idleConnTimeout: how long to keep idle upstream connections open.
+//   - responseHeaderTimeout: how long to wait for upstream response headers.
+//   - maxConnsPerHost: maximum number of connections to each upstream host, 0 for no limit.
+//   - maxIdleConnsPerHost: maximum number of idle connections kept to each upstream host.
+//   - flushInterval: how often to flush responses to the client, -1 to flush immediately.
+func NewProxy(
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	limiter *Limiter,
+	bodyRewriter *BodyRewriter,
+	streams *Streams,
+	cache *Cache,
+	flushInterval time.Duration,
+	dialTimeout time.Duration,
+	idleConnTimeout time.Duration,
+	responseHeaderTimeout time.Duration,
+	maxConnsPerHost int,
+	maxIdleConnsPerHost int,
+) *Proxy {
+	dialContext := newUpstreamDialContext(upstreamPolicy, upstreamBinder, dialTimeout)
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Connecting through a proxy would bypass the upstream policy
+	transport.Proxy = nil
+	transport.DialContext = dialContext
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+	transport.MaxConnsPerHost = maxConnsPerHost
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+
+	// Streams use dedicated connections, so their idle and lifetime timeouts do not affect
+	// pooled connections.
+	streamTransport := transport.Clone()
+	streamTransport.DisableKeepAlives = true
+	streamTransport.MaxConnsPerHost = 0
+	streamTransport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return streams.WrapConn(conn), nil
+	}
+
+	p := &Proxy{
+		transport:       transport,
+		streamTransport: streamTransport,
+		limiter:         limiter,
+		bodyRewriter:    bodyRewriter,
+		streams:         streams,
+		cache:           cache,
+	}
+	p.reverseProxy = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		ModifyResponse: p.modifyResponse,
+		Transport:      roundTripperFunc(p.roundTrip),
+		FlushInterval:  flushInterval,
+		BufferPool:     newBufferPool(32 * 1024),
+		ErrorHandler:   p.errorHandler,
+	}
+	return p
+}
+
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Value(streamKey).(string); ok {
+		return p.limitedRoundTrip(req, p.streamTransport)
+	}
+	return p.cache.RoundTrip(req, func(req *http.Request) (*http.Response, error) {
+		return p.limitedRoundTrip(req, p.transport)
+	})
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// releaseConnBody is a releaseBody for the connection of protocol upgrades, which must
+// still be writable.
+type releaseConnBody struct {
+	releaseBody
+	io.Writer
+}
+
+// limitedRoundTrip makes the request upstream with transport, within the limits of the
+// Limiter for its host (whatever the port). Responses served from the cache are not limited,
+// so they are not held by slow hosts. Streams hold their slot until closed.
+func (p *Proxy) limitedRoundTrip(req *http.Request, transport http.RoundTripper) (*http.Response, error) {
+	u := req.Context().Value(upstreamKey).(upstream)
+	release, err := p.limiter.Acquire(req.Context(), u.host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	var once sync.Once
+	body := releaseBody{
+		ReadCloser: resp.Body,
+		release:    func() { once.Do(release) },
+	}
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &releaseConnBody{releaseBody: body, Writer: conn}
+	} else {
+		resp.Body = &body
+	}
+	return resp, nil
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	u := pr.In.Context().Value(upstreamKey).(upstream)
+	pr.SetURL(u.url)
+	pr.Out.URL.User = nil
+	pr.Out.Host = u.host
+	if u.port != 80 {
+		pr.Out.Host = net.JoinHostPort(u.host, strconv.Itoa(int(u.port)))
+	}
+	setForwardedHeaders(pr)
+	if p.bodyRewriter.Enabled(u.host) {
+		p.bodyRewriter.SetAcceptEncoding(pr.Out.Header)
+	}
+	if u.pathPrefix != "" {
+		pr.Out.Header.Set("X-Forwarded-Prefix", u.pathPrefix)
+	}
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	u := resp.Request.Context().Value(upstreamKey).(upstream)
+	u.rewriteResponseHeaders(resp.Header)
+	if p.bodyRewriter.Enabled(u.host) {
+		return p.bodyRewriter.Rewrite(resp, u)
+	}
+	return nil
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	logger := log.GetLogger(req.Context())
+	if errors.Is(err, errLimiterQueueFull) || errors.Is(err, errLimiterQueueTimeout) {
+		u := req.Context().Value(upstreamKey).(upstream)
+		logger.WithFields(logrus.Fields{
+			"Host": u.host,
+		}).Warnf("Request refused: %v", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(p.limiter.RetryAfter().Seconds()))))
+		http.Error(w, fmt.Sprintf("Service unavailable: %s: %v", u.host, err), http.StatusServiceUnavailable)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"Host": req.Host,
+		"URL":  req.URL.String(),
+	}).Errorf("Proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+	fmt.Fprintf(w, "Error proxying request to '%s': %v", req.Host, err)
+}
+
+// ServeHTTP proxies the request to the given resolved mDNS host at port. publicURL maps
+// mDNS hosts to the base URL where they are accessible by the client, and is used to rewrite
+// responses referencing them.
+func (p *Proxy) ServeHTTP(
+	w http.ResponseWriter,
+	req *http.Request,
+	host mdns.Host,
+	port uint16,
+	publicURL func(host string) *url.URL,
+) {
+	ctx := req.Context()
+
+	if kind := getStreamKind(req); kind != "" {
+		client, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			client = req.RemoteAddr
+		}
+		release, err := p.streams.Acquire(kind, client, host.Name)
+		if err != nil {
+			logger := log.GetLogger(ctx)
+			logger.WithFields(logrus.Fields{
+				"Host":   host.Name,
+				"Client": client,
+				"Kind":   kind,
+			}).Warnf("Stream refused: %v", err)
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, errStreamClientLimit) {
+				status = http.StatusTooManyRequests
+			}
+			http.Error(w, fmt.Sprintf("%s: %s: %v", http.StatusText(status), host.Name, err), status)
+			return
+		}
+		defer release()
+		ctx = context.WithValue(ctx, streamKey, kind)
+	}
+
+	p.serveHTTP(ctx, w, req, host, port, publicURL)
+}
+
+func (p *Proxy) serveHTTP(
+	ctx context.Context,
+	w http.ResponseWriter,
+	req *http.Request,
+	host mdns.Host,
+	port uint16,
+	publicURL func(host string) *url.URL,
+) {
+	ctx = withUpstreamInterface(ctx, host.Interface)
+	u := upstream{
+		url: &url.URL{
+			Scheme: "http",
+			Host:   host.HostPort(port),
+		},
+		host:      host.Name,
+		ip:        host.IP,
+		port:      port,
+		publicURL: publicURL,
+	}
+	if base := publicURL(host.Name); base != nil {
+		u.pathPrefix = strings.TrimSuffix(base.Path, "/")
+	}
+	ctx = context.WithValue(ctx, upstreamKey, u)
+	p.reverseProxy.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// Close closes all idle upstream connections.
+func (p *Proxy) Close() {
+	p.transport.CloseIdleConnections()
+	p.streamTransport.CloseIdleConnections()
+}
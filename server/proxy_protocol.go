@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocolV1Signature = []byte("PROXY ")
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolV1MaxLength is the maximum length of a v1 header, including CRLF.
+var proxyProtocolV1MaxLength = 107
+
+var errProxyProtocolMissingHeader = errors.New("missing or incomplete header")
+
+// ProxyProtocolListener is a net.Listener that parses PROXY protocol v1 and v2 headers
+// from connections of trusted peers, so the addresses of the original connection are
+// reported by the accepted connections.
+type ProxyProtocolListener struct {
+	net.Listener
+	prefixes      []netip.Prefix
+	headerTimeout time.Duration
+}
+
+// NewProxyProtocolListener wraps listener so PROXY protocol headers are parsed for
+// connections from the given trusted networks, which must send one. Connections from other
+// peers are not parsed. headerTimeout limits how long to wait for the header.
+func NewProxyProtocolListener(
+	listener net.Listener,
+	trustedCIDRs []string,
+	headerTimeout time.Duration,
+) (*ProxyProtocolListener, error) {
+	if len(trustedCIDRs) == 0 {
+		return nil, errors.New("at least one trusted network is required")
+	}
+	prefixes, err := parsePrefixes(trustedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyProtocolListener{
+		Listener:      listener,
+		prefixes:      prefixes,
+		headerTimeout: headerTimeout,
+	}, nil
+}
+
+func (l *ProxyProtocolListener) isTrusted(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, prefix := range l.prefixes {
+		if prefix.Contains(addrPort.Addr().Unmap().WithZone("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept waits for and returns the next connection. The PROXY protocol header is only read
+// at the first use of the connection, so a slow peer does not block accepting others.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	headerErr     error
+	remoteAddr    net.Addr
+	localAddr     net.Addr
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout)); err != nil {
+			c.headerErr = err
+			return
+		}
+		c.headerErr = c.parseHeader()
+		if err := c.Conn.SetReadDeadline(time.Time{}); err != nil && c.headerErr == nil {
+			c.headerErr = err
+		}
+		if c.headerErr != nil {
+			c.headerErr = fmt.Errorf("PROXY protocol from %s: %w", c.Conn.RemoteAddr(), c.headerErr)
+		}
+	})
+}
+
+// parseHeader parses the header, which trusted peers must send, so their own address is
+// never mistaken for the client's.
+func (c *proxyProtocolConn) parseHeader() error {
+	signature, err := c.reader.Peek(len(proxyProtocolV1Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV1Signature) {
+		err = c.parseV1()
+	} else if err == nil {
+		signature, err = c.reader.Peek(len(proxyProtocolV2Signature))
+		if err == nil && !bytes.Equal(signature, proxyProtocolV2Signature) {
+			return errProxyProtocolMissingHeader
+		}
+		if err == nil {
+			err = c.parseV2()
+		}
+	}
+	// Connections closed before or within the header fail the same way for both versions
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errProxyProtocolMissingHeader
+	}
+	return err
+}
+
+func (c *proxyProtocolConn) parseV1() error {
+	var line []byte
+	for {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return errors.New("v1 header too long")
+		}
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid v1 header: %#v", string(line))
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil
+	case "TCP4", "TCP6":
+	default:
+		return fmt.Errorf("invalid v1 protocol: %#v", fields[1])
+	}
+	if len(fields) != 6 {
+		return fmt.Errorf("invalid v1 header: %#v", string(line))
+	}
+	srcAddr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return err
+	}
+	dstAddr, err := netip.ParseAddr(fields[3])
+	if err != nil {
+		return err
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return err
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return err
+	}
+	c.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcAddr, uint16(srcPort)))
+	c.localAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstAddr, uint16(dstPort)))
+	return nil
+}
+
+func (c *proxyProtocolConn) parseV2() error {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	verCmd := header[12]
+	famProto := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+
+	if verCmd>>4 != 2 {
+		return fmt.Errorf("invalid v2 version: %d", verCmd>>4)
+	}
+	switch verCmd & 0xf {
+	case 0x0:
+		// LOCAL: connection established by the proxy itself
+		return nil
+	case 0x1:
+		// PROXY
+	default:
+		return fmt.Errorf("invalid v2 command: %d", verCmd&0xf)
+	}
+
+	var addrLen int
+	switch famProto {
+	case 0x11:
+		// TCP over IPv4
+		addrLen = 4
+	case 0x21:
+		// TCP over IPv6
+		addrLen = 16
+	default:
+		// Unsupported family or protocol: use the connection addresses
+		return nil
+	}
+	if len(payload) < 2*addrLen+4 {
+		return errors.New("v2 address block too short")
+	}
+	srcAddr, _ := netip.AddrFromSlice(payload[:addrLen])
+	dstAddr, _ := netip.AddrFromSlice(payload[addrLen : 2*addrLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*addrLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*addrLen+2:])
+	c.remoteAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcAddr, srcPort))
+	c.localAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstAddr, dstPort))
+	return nil
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
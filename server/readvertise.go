@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// readvertiseMaxRenames is how many times services are renamed on collisions.
+var readvertiseMaxRenames = 10
+
+type readvertisedHost struct {
+	// key identifies the published records, so changes can be detected.
+	key          string
+	hostGroup    *mdns.Group
+	serviceGroup *mdns.Group
+}
+
+func (h *readvertisedHost) close() {
+	if h.serviceGroup != nil {
+		h.serviceGroup.Close()
+	}
+	if h.hostGroup != nil {
+		h.hostGroup.Close()
+	}
+}
+
+// Readvertiser publishes discovered hosts with mDNS at a client facing interface, as
+// ${alias}.${baseDomain} with the proxy addresses, along with services pointing to the proxy.
+type Readvertiser struct {
+	ifaceName       string
+	proto           mdns.Proto
+	baseDomain      string
+	service         string
+	timeout         time.Duration
+	browse          func(context.Context, string) ([]mdns.Service, error)
+	hostAliases     *HostAliases
+	hostPolicy      *HostPolicy
+	serviceType     string
+	port            uint16
+	refreshInterval time.Duration
+
+	publisher *mdns.Publisher
+	hosts     map[string]*readvertisedHost
+	// serviceNames maps service names to the names published after collisions.
+	serviceNames map[string]string
+	stop         chan struct{}
+	stopOnce     sync.Once
+	done         chan struct{}
+}
+
+// NewReadvertiser creates a new Readvertiser, which publishes at clientIfaceName hosts
+// discovered at ifaceName. Services are published as serviceType (eg: _http._tcp) at port.
+func NewReadvertiser(
+	clientIfaceName string,
+	ifaceName string,
+	baseDomain string,
+	service string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	serviceType string,
+	port uint16,
+	refreshInterval time.Duration,
+) (*Readvertiser, error) {
+	if clientIfaceName == mdns.AnyIface {
+		return nil, fmt.Errorf("a client interface must be given")
+	}
+	if clientIfaceName == ifaceName {
+		return nil, fmt.Errorf("client interface must not be the interface hosts are discovered at")
+	}
+	if refreshInterval <= 0 {
+		return nil, fmt.Errorf("refresh interval must be positive")
+	}
+	proto := getProto(disableIPv4, disableIPv6)
+	return &Readvertiser{
+		ifaceName:       clientIfaceName,
+		proto:           proto,
+		baseDomain:      strings.ToLower(strings.TrimSuffix(baseDomain, ".")),
+		service:         service,
+		timeout:         timeout,
+		browse:          getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostAliases:     hostAliases,
+		hostPolicy:      hostPolicy,
+		serviceType:     serviceType,
+		port:            port,
+		refreshInterval: refreshInterval,
+		hosts:           map[string]*readvertisedHost{},
+		serviceNames:    map[string]string{},
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}, nil
+}
+
+// Start connects to Avahi.
+func (r *Readvertiser) Start() error {
+	if _, err := net.InterfaceByName(r.ifaceName); err != nil {
+		return err
+	}
+	publisher, err := mdns.NewPublisher()
+	if err != nil {
+		return fmt.Errorf("error connecting to Avahi: %w", err)
+	}
+	r.publisher = publisher
+	return nil
+}
+
+// Serve keeps published records in sync with discovered hosts, until Close is called.
+func (r *Readvertiser) Serve(ctx context.Context) {
+	defer close(r.done)
+	logger := log.GetLogger(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger.Infof("Re-advertising hosts at %s", r.ifaceName)
+	ticker := time.NewTicker(r.refreshInterval)
+	defer ticker.Stop()
+	for {
+		r.refresh(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for _, host := range r.hosts {
+				host.close()
+			}
+			r.publisher.Close()
+			return
+		}
+	}
+}
+
+// Close withdraws all published records, waiting for Serve to return.
+func (r *Readvertiser) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+// getAddresses returns the addresses of the client interface to publish.
+func (r *Readvertiser) getAddresses() ([]net.IP, error) {
+	iface, err := net.InterfaceByName(r.ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		isIPv4 := ipNet.IP.To4() != nil
+		if (isIPv4 && r.proto == mdns.ProtoInet6) || (!isIPv4 && r.proto == mdns.ProtoInet) {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses at %s", r.ifaceName)
+	}
+	return ips, nil
+}
+
+func (r *Readvertiser) refresh(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	ips, err := r.getAddresses()
+	if err != nil {
+		logger.Errorf("Error re-advertising hosts: %v", err)
+		return
+	}
+	services, err := r.browse(ctx, r.service)
+	if err != nil {
+		logger.Errorf("Error re-advertising hosts: %v", err)
+		return
+	}
+	r.hostAliases.Learn(services)
+	r.hostPolicy.Learn(r.service, services)
+
+	hostServices := map[string][]mdns.PublishedService{}
+	for _, service := range services {
+		// Only services at the port proxied to are re-advertised
+		if service.Port != 80 {
+			continue
+		}
+		// Skip hosts published by this proxy
+		if strings.HasSuffix(strings.ToLower(strings.TrimSuffix(service.Host, ".")), "."+r.baseDomain) {
+			continue
+		}
+		allowed, err := r.hostPolicy.Allowed(ctx, service.Host, r.browse)
+		if err != nil {
+			logger.Errorf("Error checking host policy for '%s': %v", service.Host, err)
+			return
+		}
+		if !allowed {
+			continue
+		}
+		label := r.hostAliases.Alias(service.Host)
+		duplicate := false
+		for _, publishedService := range hostServices[label] {
+			if publishedService.Name == service.Name {
+				duplicate = true
+			}
+		}
+		if duplicate {
+			continue
+		}
+		hostServices[label] = append(hostServices[label], mdns.PublishedService{
+			Name: service.Name,
+			Type: r.serviceType,
+			Port: r.port,
+			Txt:  service.Txt,
+		})
+	}
+
+	for label, host := range r.hosts {
+		if _, ok := hostServices[label]; !ok {
+			logger.WithField("Host", label).Info("Withdrawing re-advertised host")
+			host.close()
+			delete(r.hosts, label)
+		}
+	}
+	for label, publishedServices := range hostServices {
+		sort.Slice(publishedServices, func(i, j int) bool {
+			return publishedServices[i].Name < publishedServices[j].Name
+		})
+		key := fmt.Sprintf("%v %v", ips, publishedServices)
+		if host, ok := r.hosts[label]; ok {
+			// Failed and collided records are published again
+			if host.key == key &&
+				host.hostGroup != nil && host.hostGroup.Err() == nil &&
+				host.serviceGroup != nil && host.serviceGroup.Err() == nil {
+				continue
+			}
+			host.close()
+			delete(r.hosts, label)
+		}
+		r.hosts[label] = r.publish(logger.WithField("Host", label), label, ips, publishedServices, key)
+	}
+}
+
+// publish publishes a host and its services. Hosts with collisions are not published, as
+// renaming them would break routing, but services are renamed.
+func (r *Readvertiser) publish(
+	logger *logrus.Entry,
+	label string,
+	ips []net.IP,
+	publishedServices []mdns.PublishedService,
+	key string,
+) *readvertisedHost {
+	host := &readvertisedHost{key: key}
+	name := fmt.Sprintf("%s.%s", label, r.baseDomain)
+	var err error
+	host.hostGroup, err = r.publisher.Publish(r.ifaceName, r.proto, name, ips, nil, r.timeout)
+	if err != nil {
+		logger.Warnf("Error re-advertising host %s: %v", name, err)
+		return host
+	}
+
+	for i := 0; i <= readvertiseMaxRenames; i++ {
+		services := make([]mdns.PublishedService, len(publishedServices))
+		for j, service := range publishedServices {
+			if publishedName, ok := r.serviceNames[service.Name]; ok {
+				service.Name = publishedName
+			}
+			services[j] = service
+		}
+		host.serviceGroup, err = r.publisher.Publish(r.ifaceName, r.proto, name, nil, services, r.timeout)
+		if !errors.Is(err, mdns.ErrCollision) {
+			break
+		}
+		for _, service := range publishedServices {
+			publishedName, ok := r.serviceNames[service.Name]
+			if !ok {
+				publishedName = service.Name
+			}
+			alternativeName, err := r.publisher.AlternativeServiceName(publishedName)
+			if err != nil {
+				logger.Warnf("Error renaming service '%s': %v", publishedName, err)
+				return host
+			}
+			r.serviceNames[service.Name] = alternativeName
+		}
+	}
+	if err != nil {
+		logger.Warnf("Error re-advertising services of %s: %v", name, err)
+		return host
+	}
+	logger.Infof("Re-advertised host as %s", name)
+	return host
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/fornellas/mdns-proxy/log"
+)
+
+var reflectorMetrics = expvar.NewMap("reflector")
+
+var mdnsPort = 5353
+var mdnsGroupIPv4 = net.IPv4(224, 0, 0, 251)
+var mdnsGroupIPv6 = net.ParseIP("ff02::fb")
+
+// reflectorLocalAddrsInterval is how often the addresses of this host are refreshed.
+var reflectorLocalAddrsInterval = 30 * time.Second
+
+type reflectRuleKind int
+
+const (
+	reflectRuleHost reflectRuleKind = iota
+	reflectRuleService
+)
+
+type reflectRule struct {
+	from    string
+	to      string
+	kind    reflectRuleKind
+	pattern string
+}
+
+func newReflectRule(rule string) (reflectRule, error) {
+	r := reflectRule{from: "*", to: "*"}
+	value := rule
+	if direction, rest, ok := strings.Cut(rule, ":"); ok && strings.Contains(direction, ">") {
+		r.from, r.to, _ = strings.Cut(direction, ">")
+		value = rest
+	}
+	kind, pattern, ok := strings.Cut(value, ":")
+	if !ok || pattern == "" || r.from == "" || r.to == "" {
+		return reflectRule{}, fmt.Errorf("invalid rule %#v: must be in the format [<from>><to>:]<host|service>:<glob>", rule)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return reflectRule{}, fmt.Errorf("invalid rule %#v: %w", rule, err)
+	}
+	switch kind {
+	case "host":
+		r.kind = reflectRuleHost
+	case "service":
+		r.kind = reflectRuleService
+	default:
+		return reflectRule{}, fmt.Errorf("invalid rule %#v: unknown kind %#v", rule, kind)
+	}
+	r.pattern = strings.ToLower(pattern)
+	return r, nil
+}
+
+func (r reflectRule) appliesTo(from, to string) bool {
+	return (r.from == "*" || r.from == from) && (r.to == "*" || r.to == to)
+}
+
+func (r reflectRule) match(kind reflectRuleKind, name string) bool {
+	if r.kind != kind {
+		return false
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+// getReflectName returns what a question or record refers to: either a service type (eg:
+// _http._tcp) or a host name (eg: foo.local).
+func getReflectName(name string, rr dns.RR) (reflectRuleKind, string) {
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	// Service type enumeration refers to the enumerated types
+	if len(labels) >= 3 && labels[0] == "_services" && labels[1] == "_dns-sd" && labels[2] == "_udp" {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			labels = dns.SplitDomainName(dns.CanonicalName(ptr.Ptr))
+		}
+	}
+	// Reverse lookups refer to host names
+	if strings.HasSuffix(dns.CanonicalName(name), ".arpa.") {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			return reflectRuleHost, strings.TrimSuffix(dns.CanonicalName(ptr.Ptr), ".")
+		}
+		return reflectRuleHost, strings.TrimSuffix(dns.CanonicalName(name), ".")
+	}
+	for i := 1; i < len(labels); i++ {
+		if (labels[i] == "_tcp" || labels[i] == "_udp") && strings.HasPrefix(labels[i-1], "_") {
+			return reflectRuleService, labels[i-1] + "." + labels[i]
+		}
+	}
+	return reflectRuleHost, strings.Join(labels, ".")
+}
+
+type reflectorConn interface {
+	ReadFrom(b []byte) (n int, ifIndex int, src net.Addr, err error)
+	WriteTo(b []byte, ifIndex int) error
+	Close() error
+}
+
+type reflectorConn4 struct {
+	*ipv4.PacketConn
+}
+
+func (c reflectorConn4) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.PacketConn.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c reflectorConn4) WriteTo(b []byte, ifIndex int) error {
+	_, err := c.PacketConn.WriteTo(
+		b, &ipv4.ControlMessage{IfIndex: ifIndex}, &net.UDPAddr{IP: mdnsGroupIPv4, Port: mdnsPort},
+	)
+	return err
+}
+
+type reflectorConn6 struct {
+	*ipv6.PacketConn
+}
+
+func (c reflectorConn6) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.PacketConn.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c reflectorConn6) WriteTo(b []byte, ifIndex int) error {
+	_, err := c.PacketConn.WriteTo(
+		b, &ipv6.ControlMessage{IfIndex: ifIndex}, &net.UDPAddr{IP: mdnsGroupIPv6, Port: mdnsPort},
+	)
+	return err
+}
+
+// Reflector relays mDNS queries and responses between interfaces, only passing questions
+// and records allowed by its rules.
+//
+// Rules are in the format [<from>><to>:]<kind>:<glob>, where from and to are interface names
+// (or * for any), and kind is either host (host names, eg: foo.local) or service (service
+// types, eg: _http._tcp). A question or record is reflected if it matches no deny rule and,
+// when allow rules of its kind are set, it matches at least one of them. Host records
+// (including reverse lookups) are of the host kind, so service allow rules do not restrict
+// them.
+//
+// Records are reflected as is. The only change to packets is clearing the unicast response
+// bit of reflected questions, as unicast answers would only reach the reflector.
+type Reflector struct {
+	ifaces      []*net.Interface
+	disableIPv4 bool
+	disableIPv6 bool
+	allowRules  []reflectRule
+	denyRules   []reflectRule
+
+	conns  []reflectorConn
+	mutex  sync.Mutex
+	closed bool
+	// localIPs are the addresses of this host.
+	localIPs []net.IP
+}
+
+// NewReflector creates a new Reflector between the given interfaces.
+func NewReflector(
+	ifaceNames []string,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	allow []string,
+	deny []string,
+) (*Reflector, error) {
+	if len(ifaceNames) < 2 {
+		return nil, fmt.Errorf("at least two interfaces are required")
+	}
+	r := &Reflector{
+		disableIPv4: disableIPv4,
+		disableIPv6: disableIPv6,
+	}
+	for _, ifaceName := range ifaceNames {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface %#v: %w", ifaceName, err)
+		}
+		r.ifaces = append(r.ifaces, iface)
+	}
+	for _, rules := range []struct {
+		rules  []string
+		parsed *[]reflectRule
+	}{{allow, &r.allowRules}, {deny, &r.denyRules}} {
+		for _, rule := range rules.rules {
+			parsed, err := newReflectRule(rule)
+			if err != nil {
+				return nil, err
+			}
+			*rules.parsed = append(*rules.parsed, parsed)
+		}
+	}
+	return r, nil
+}
+
+func listenMdns(network string) (net.PacketConn, error) {
+	listenConfig := net.ListenConfig{
+		// Avahi is usually listening on the same port
+		Control: func(network, address string, c syscall.RawConn) error {
+			var reuseErr error
+			if err := c.Control(func(fd uintptr) {
+				reuseErr = setReuseAddr(fd)
+			}); err != nil {
+				return err
+			}
+			return reuseErr
+		},
+	}
+	return listenConfig.ListenPacket(context.Background(), network, fmt.Sprintf(":%d", mdnsPort))
+}
+
+// Listen joins the mDNS multicast groups at all interfaces.
+func (r *Reflector) Listen() error {
+	if err := r.refreshLocalIPs(); err != nil {
+		return fmt.Errorf("error getting local addresses: %w", err)
+	}
+	if !r.disableIPv4 {
+		packetConn, err := listenMdns("udp4")
+		if err != nil {
+			return fmt.Errorf("error listening on udp4 port %d: %w", mdnsPort, err)
+		}
+		conn := ipv4.NewPacketConn(packetConn)
+		r.conns = append(r.conns, reflectorConn4{conn})
+		if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+			r.Close()
+			return err
+		}
+		// Reflected packets must not be received again
+		if err := conn.SetMulticastLoopback(false); err != nil {
+			r.Close()
+			return err
+		}
+		conn.SetMulticastTTL(255)
+		for _, iface := range r.ifaces {
+			if err := conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv4}); err != nil {
+				r.Close()
+				return fmt.Errorf("error joining mDNS group at %s: %w", iface.Name, err)
+			}
+		}
+	}
+	if !r.disableIPv6 {
+		packetConn, err := listenMdns("udp6")
+		if err != nil {
+			r.Close()
+			return fmt.Errorf("error listening on udp6 port %d: %w", mdnsPort, err)
+		}
+		conn := ipv6.NewPacketConn(packetConn)
+		r.conns = append(r.conns, reflectorConn6{conn})
+		if err := conn.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+			r.Close()
+			return err
+		}
+		if err := conn.SetMulticastLoopback(false); err != nil {
+			r.Close()
+			return err
+		}
+		conn.SetMulticastHopLimit(255)
+		for _, iface := range r.ifaces {
+			if err := conn.JoinGroup(iface, &net.UDPAddr{IP: mdnsGroupIPv6}); err != nil {
+				r.Close()
+				return fmt.Errorf("error joining mDNS group at %s: %w", iface.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Serve reflects packets, until Close is called.
+func (r *Reflector) Serve(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	names := []string{}
+	for _, iface := range r.ifaces {
+		names = append(names, iface.Name)
+	}
+	logger.Infof("Starting mDNS reflector between %s", strings.Join(names, ", "))
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(reflectorLocalAddrsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.refreshLocalIPs(); err != nil {
+					logger.Errorf("Error getting local addresses: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, conn := range r.conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.serveConn(logger, conn)
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
+
+// Close stops reflecting.
+func (r *Reflector) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+// refreshLocalIPs updates the addresses of this host.
+func (r *Reflector) refreshLocalIPs() error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	localIPs := []net.IP{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			localIPs = append(localIPs, ipNet.IP)
+		}
+	}
+	r.mutex.Lock()
+	r.localIPs = localIPs
+	r.mutex.Unlock()
+	return nil
+}
+
+// isLocalAddr returns whether addr is of this host, so packets sent by the local mDNS
+// responder, which is already present at all interfaces, are not reflected.
+func (r *Reflector) isLocalAddr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, ip := range r.localIPs {
+		if ip.Equal(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reflector) serveConn(logger *logrus.Logger, conn reflectorConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, src, err := conn.ReadFrom(buf)
+		if err != nil {
+			r.mutex.Lock()
+			closed := r.closed
+			r.mutex.Unlock()
+			if !closed && !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("mDNS reflector error: %v", err)
+			}
+			return
+		}
+		reflectorMetrics.Add("received", 1)
+		var from *net.Interface
+		for _, iface := range r.ifaces {
+			if iface.Index == ifIndex {
+				from = iface
+			}
+		}
+		// Legacy unicast queries (RFC 6762, section 6.7) expect direct answers
+		if udpAddr, ok := src.(*net.UDPAddr); from == nil || !ok || udpAddr.Port != mdnsPort || r.isLocalAddr(src) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			reflectorMetrics.Add("invalid", 1)
+			continue
+		}
+		for _, to := range r.ifaces {
+			if to.Index == from.Index {
+				continue
+			}
+			reflected, ok := r.filter(msg, from.Name, to.Name)
+			if !ok {
+				reflectorMetrics.Add("filtered", 1)
+				continue
+			}
+			packed, err := reflected.Pack()
+			if err != nil {
+				reflectorMetrics.Add("invalid", 1)
+				continue
+			}
+			if err := conn.WriteTo(packed, to.Index); err != nil {
+				logger.WithFields(logrus.Fields{
+					"From": from.Name,
+					"To":   to.Name,
+				}).Warnf("Error reflecting mDNS packet: %v", err)
+				continue
+			}
+			reflectorMetrics.Add("reflected", 1)
+		}
+	}
+}
+
+func (r *Reflector) allowed(from, to string, name string, rr dns.RR) bool {
+	kind, reflectName := getReflectName(name, rr)
+	for _, rule := range r.denyRules {
+		if rule.appliesTo(from, to) && rule.match(kind, reflectName) {
+			return false
+		}
+	}
+	hasAllowRules := false
+	for _, rule := range r.allowRules {
+		if !rule.appliesTo(from, to) || rule.kind != kind {
+			continue
+		}
+		hasAllowRules = true
+		if rule.match(kind, reflectName) {
+			return true
+		}
+	}
+	return !hasAllowRules
+}
+
+// filter returns a copy of msg with only allowed questions and records from an interface to
+// another, and whether anything is left to be reflected.
+func (r *Reflector) filter(msg *dns.Msg, from, to string) (*dns.Msg, bool) {
+	reflected := msg.Copy()
+	reflected.Question = nil
+	for _, question := range msg.Question {
+		if !r.allowed(from, to, question.Name, nil) {
+			continue
+		}
+		// Answers must be multicast, so they can be reflected back
+		question.Qclass &^= 1 << 15
+		reflected.Question = append(reflected.Question, question)
+	}
+	filterRRs := func(rrs []dns.RR) []dns.RR {
+		filtered := []dns.RR{}
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.OPT); ok || r.allowed(from, to, rr.Header().Name, rr) {
+				filtered = append(filtered, rr)
+			}
+		}
+		return filtered
+	}
+	reflected.Answer = filterRRs(msg.Answer)
+	reflected.Ns = filterRRs(msg.Ns)
+	reflected.Extra = filterRRs(msg.Extra)
+	if len(reflected.Question) == 0 && len(reflected.Answer) == 0 {
+		return nil, false
+	}
+	return reflected, true
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package server
+
+func setReuseAddr(fd uintptr) error {
+	return nil
+}
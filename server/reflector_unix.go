@@ -0,0 +1,14 @@
+//go:build unix
+
+package server
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func setReuseAddr(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
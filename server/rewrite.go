@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// publicBaseURL returns the public base URL for the given host, as referenced by the
+// upstream (either a mDNS host name or the upstream IP), at the given port. It returns nil
+// for hosts which are not proxied.
+func (u upstream) publicBaseURL(hostname string, scheme string, port string) *url.URL {
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	if scheme != u.url.Scheme || port != strconv.Itoa(int(u.port)) {
+		return nil
+	}
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if ip := net.ParseIP(strings.Split(hostname, "%")[0]); ip != nil {
+		if !ip.Equal(u.ip) {
+			return nil
+		}
+		hostname = u.host
+	}
+	return u.publicURL(hostname)
+}
+
+// rewriteURL rewrites an URL referencing a mDNS host or the upstream IP to its public URL.
+// Absolute paths are prefixed with the upstream path prefix. Other URLs are returned
+// unchanged.
+func (u upstream) rewriteURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if parsed.Scheme == "" && parsed.Host == "" {
+		if u.pathPrefix != "" && strings.HasPrefix(rawURL, "/") {
+			return u.pathPrefix + rawURL
+		}
+		return rawURL
+	}
+	scheme := parsed.Scheme
+	if scheme == "" {
+		scheme = u.url.Scheme
+	}
+	base := u.publicBaseURL(parsed.Hostname(), scheme, parsed.Port())
+	if base == nil {
+		return rawURL
+	}
+	rewritten := *parsed
+	if parsed.Scheme != "" {
+		rewritten.Scheme = base.Scheme
+	}
+	rewritten.Host = base.Host
+	rewritten.Path = strings.TrimSuffix(base.Path, "/") + parsed.Path
+	if parsed.RawPath != "" {
+		rewritten.RawPath = strings.TrimSuffix(base.Path, "/") + parsed.RawPath
+	}
+	return rewritten.String()
+}
+
+var refreshURLRegexp = regexp.MustCompile(`(?i)^(\s*\d+\s*[;,]\s*url\s*=\s*)(['"]?)([^'"]*)(['"]?\s*)$`)
+
+// rewriteRefresh rewrites the URL of a Refresh header value (eg: "5; url=http://foo.local/").
+func (u upstream) rewriteRefresh(value string) string {
+	match := refreshURLRegexp.FindStringSubmatch(value)
+	if match == nil {
+		return value
+	}
+	return match[1] + match[2] + u.rewriteURL(match[3]) + match[4]
+}
+
+// rewriteSetCookie rewrites the Domain attribute of a Set-Cookie header value, when it
+// references a mDNS host or the upstream IP, and prefixes its Path attribute with the
+// upstream path prefix.
+func (u upstream) rewriteSetCookie(value string) string {
+	attributes := strings.Split(value, ";")
+	for i, attribute := range attributes {
+		// The first attribute is the cookie name and value
+		if i == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(attribute), "=")
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(key, "path") {
+			if u.pathPrefix != "" && strings.HasPrefix(value, "/") {
+				attributes[i] = " Path=" + u.pathPrefix + value
+			}
+			continue
+		}
+		if !strings.EqualFold(key, "domain") {
+			continue
+		}
+		base := u.publicBaseURL(strings.TrimPrefix(value, "."), u.url.Scheme, "")
+		if base == nil {
+			continue
+		}
+		attributes[i] = " Domain=" + base.Hostname()
+	}
+	return strings.Join(attributes, ";")
+}
+
+// rewriteResponseHeaders rewrites response headers referencing mDNS hosts or the upstream
+// IP, so they point to the proxy instead.
+func (u upstream) rewriteResponseHeaders(header http.Header) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if value := header.Get(name); value != "" {
+			header.Set(name, u.rewriteURL(value))
+		}
+	}
+	if value := header.Get("Refresh"); value != "" {
+		header.Set("Refresh", u.rewriteRefresh(value))
+	}
+	if values := header.Values("Set-Cookie"); len(values) > 0 {
+		header.Del("Set-Cookie")
+		for _, value := range values {
+			header.Add("Set-Cookie", u.rewriteSetCookie(value))
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// RoutingSubdomain routes requests to mDNS hosts by subdomain (eg: foo.example.com).
+var RoutingSubdomain = "subdomain"
+
+// RoutingPath routes requests to mDNS hosts by path (eg: example.com/d/foo/).
+var RoutingPath = "path"
+
+// Routing defines how mDNS hosts are mapped to URLs.
+type Routing struct {
+	mode       string
+	pathPrefix string
+}
+
+// NewRouting creates a new Routing. pathPrefix is only used with RoutingPath.
+func NewRouting(mode string, pathPrefix string) (*Routing, error) {
+	switch mode {
+	case RoutingSubdomain, RoutingPath:
+	default:
+		return nil, fmt.Errorf(
+			"invalid routing mode %#v: must be either %s or %s",
+			mode, RoutingSubdomain, RoutingPath,
+		)
+	}
+	pathPrefix = fmt.Sprintf("/%s/", strings.Trim(pathPrefix, "/"))
+	if mode == RoutingPath && pathPrefix == "//" {
+		return nil, fmt.Errorf("invalid path prefix %#v: must not be empty", pathPrefix)
+	}
+	if _, err := url.ParseRequestURI(pathPrefix); err != nil {
+		return nil, fmt.Errorf("invalid path prefix %#v: %w", pathPrefix, err)
+	}
+	return &Routing{
+		mode:       mode,
+		pathPrefix: pathPrefix,
+	}, nil
+}
+
+// publicURL returns the base URL for a host with the given alias.
+func (r *Routing) publicURL(scheme string, baseHost string, alias string) *url.URL {
+	if r.mode == RoutingPath {
+		return &url.URL{
+			Scheme: scheme,
+			Host:   baseHost,
+			Path:   fmt.Sprintf("%s%s/", r.pathPrefix, alias),
+		}
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   fmt.Sprintf("%s.%s", alias, baseHost),
+		Path:   "/",
+	}
+}
+
+// parsePath parses the escaped path of a request in RoutingPath mode, returning the host
+// alias and the remaining path to proxy. The remaining path is empty when the path
+// lacks a trailing slash after the alias.
+func (r *Routing) parsePath(escapedPath string) (alias string, path string, ok bool) {
+	rest, ok := strings.CutPrefix(escapedPath, r.pathPrefix)
+	if !ok {
+		return "", "", false
+	}
+	escapedAlias, escapedRest, found := strings.Cut(rest, "/")
+	alias, err := url.PathUnescape(escapedAlias)
+	if err != nil || alias == "" || strings.Contains(alias, ".") {
+		return "", "", false
+	}
+	if !found {
+		return alias, "", true
+	}
+	return alias, "/" + escapedRest, true
+}
@@ -3,8 +3,9 @@ package server
 import (
 	"context"
 	"fmt"
+	"html"
+	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"sort"
 	"strconv"
@@ -12,18 +13,20 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/fornellas/mdns-proxy/log"
 	"github.com/fornellas/mdns-proxy/mdns"
 )
 
 func getScheme(req *http.Request) string {
-	scheme := req.Header.Get("X-Scheme")
-	if scheme == "" {
-		scheme = "http"
-		if req.TLS != nil {
-			scheme = "https"
-		}
+	if info, ok := getForwardedInfo(req); ok {
+		return info.scheme
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
 	}
 	return scheme
 }
@@ -50,6 +53,79 @@ func getAddrPort(req *http.Request) (string, int, error) {
 	return addr, port, nil
 }
 
+// getPublicURL returns a function which maps mDNS hosts (eg: foo.local) to the base URL
+// where they are accessible by the client of req. The function returns nil for hosts
+// outside of mdnsDomain.
+func getPublicURL(
+	req *http.Request,
+	baseDomain string,
+	mdnsDomain string,
+	hostAliases *HostAliases,
+	routing *Routing,
+) (func(host string) *url.URL, error) {
+	scheme := getScheme(req)
+	_, port, err := getAddrPort(req)
+	if err != nil {
+		return nil, err
+	}
+	baseHost := baseDomain
+	if !(scheme == "http" && port == 80) && !(scheme == "https" && port == 443) {
+		baseHost = net.JoinHostPort(baseHost, strconv.Itoa(port))
+	}
+	return func(host string) *url.URL {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if !strings.HasSuffix(host, fmt.Sprintf(".%s", mdnsDomain)) {
+			return nil
+		}
+		return routing.publicURL(scheme, baseHost, hostAliases.Alias(host))
+	}, nil
+}
+
+func getProto(disableIPv4 bool, disableIPv6 bool) mdns.Proto {
+	proto := mdns.ProtoAny
+	if disableIPv4 {
+		proto = mdns.ProtoInet6
+	}
+	if disableIPv6 {
+		proto = mdns.ProtoInet
+	}
+	return proto
+}
+
+func getServiceBrowser(
+	ifaceName string,
+	mdnsDomain string,
+	timeout time.Duration,
+	proto mdns.Proto,
+) func(context.Context, string) ([]mdns.Service, error) {
+	return func(ctx context.Context, serviceType string) ([]mdns.Service, error) {
+		m, err := mdns.NewMDNS()
+		if err != nil {
+			return nil, err
+		}
+		defer m.Close()
+		services, err := m.BrowseServices(
+			ctx,
+			ifaceName,
+			proto,
+			serviceType,
+			mdnsDomain,
+			timeout,
+		)
+		if err != nil {
+			return nil, err
+		}
+		// Proxies are not proxied
+		filteredServices := []mdns.Service{}
+		for _, service := range services {
+			if _, ok := service.Txt[AdvertiseTxtKey]; !ok {
+				filteredServices = append(filteredServices, service)
+			}
+		}
+		return filteredServices, nil
+	}
+}
+
 func handleListMdnsHosts(
 	ctx context.Context,
 	baseDomain string,
@@ -58,6 +134,9 @@ func handleListMdnsHosts(
 	mdnsDomain string,
 	timeout time.Duration,
 	proto mdns.Proto,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	routing *Routing,
 	w http.ResponseWriter,
 	req *http.Request,
 ) {
@@ -70,48 +149,22 @@ func handleListMdnsHosts(
 		"timeout":    timeout,
 		"proto":      proto,
 	}).Info("handleListMdnsHosts")
-	m, err := mdns.NewMDNS()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "Error getting mDNS client: %v", err)
-		return
-	}
-	defer m.Close()
-
-	scheme := getScheme(req)
-
-	_, port, err := getAddrPort(req)
+	publicURL, err := getPublicURL(req, baseDomain, mdnsDomain, hostAliases, routing)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error identifying host address and port '%s': %v", req.Host, err)
+		return
 	}
 
-	services, err := m.BrowseServices(
-		ctx,
-		ifaceName,
-		proto,
-		service,
-		mdnsDomain,
-		timeout,
-	)
+	browse := getServiceBrowser(ifaceName, mdnsDomain, timeout, proto)
+	services, err := browse(ctx, service)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error querying mDNS: %v", err)
 		return
 	}
-
-	w.Header().Set("Content-Type", "text/html")
-
-	fmt.Fprint(w, `
-			<!DOCTYPE html>
-				<html>
-				<head>
-					<title>mDNS Hosts</title>
-				</head>
-				<body>
-					<h1>mDNS Hosts</h1>
-					<ul>
-		`)
+	hostAliases.Learn(services)
+	hostPolicy.Learn(service, services)
 
 	hosts := []string{}
 	for _, service := range services {
@@ -122,19 +175,48 @@ func handleListMdnsHosts(
 	}
 	sort.Strings(hosts)
 
+	allowedHosts := []string{}
 	var last_host string
 	for _, host := range hosts {
 		if host == last_host {
 			continue
 		}
-		fmt.Fprintf(w, `					<li><a href="%s://%s.%s:%d/">%s</a></li>`,
-			scheme,
-			strings.TrimSuffix(host, fmt.Sprintf(".%s", mdnsDomain)),
-			baseDomain,
-			port,
-			host,
-		)
 		last_host = host
+		allowed, err := hostPolicy.Allowed(ctx, host, browse)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Error checking host policy for '%s': %v", host, err)
+			return
+		}
+		if allowed {
+			allowedHosts = append(allowedHosts, host)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+
+	fmt.Fprint(w, `
+			<!DOCTYPE html>
+				<html>
+				<head>
+					<title>mDNS Hosts</title>
+				</head>
+				<body>
+					<h1>mDNS Hosts</h1>
+					<ul>
+		`)
+
+	for _, host := range allowedHosts {
+		var description string
+		if d := hostAliases.Description(host); d != "" {
+			description = fmt.Sprintf(": %s", html.EscapeString(d))
+		}
+		fmt.Fprintf(w, `					<li><a href="%s">%s</a> (%s)%s</li>`,
+			html.EscapeString(publicURL(host).String()),
+			html.EscapeString(hostAliases.DisplayName(host)),
+			html.EscapeString(host),
+			description,
+		)
 	}
 
 	fmt.Fprint(w, `
@@ -150,6 +232,10 @@ func handleProxyMdnsHosts(
 	ifaceName string,
 	mdnsDomain string,
 	proto mdns.Proto,
+	host string,
+	hostAliases *HostAliases,
+	routing *Routing,
+	proxy *Proxy,
 	w http.ResponseWriter,
 	req *http.Request,
 ) {
@@ -159,6 +245,7 @@ func handleProxyMdnsHosts(
 		"ifaceName":  ifaceName,
 		"mdnsDomain": mdnsDomain,
 		"proto":      proto,
+		"host":       host,
 	}).Info("handleProxyMdnsHosts")
 	m, err := mdns.NewMDNS()
 	if err != nil {
@@ -168,16 +255,15 @@ func handleProxyMdnsHosts(
 	}
 	defer m.Close()
 
-	addr, _, err := getAddrPort(req)
+	publicURL, err := getPublicURL(req, baseDomain, mdnsDomain, hostAliases, routing)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error identifying host address and port '%s': %v", req.Host, err)
+		return
 	}
 
-	host := fmt.Sprintf("%s.%s", strings.TrimSuffix(addr, fmt.Sprintf(".%s", baseDomain)), mdnsDomain)
-
 	logger.Info("ResolveHost")
-	ip, err := m.ResolveHost(
+	resolvedHost, err := m.ResolveHost(
 		host,
 		ifaceName,
 		proto,
@@ -185,21 +271,53 @@ func handleProxyMdnsHosts(
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Error resolving host '%s': %v", host, err)
+		return
 	}
 
-	req.URL.Scheme = "http"
-	req.URL.User = nil
-	req.URL.Host = host
-	req.Header["Host"] = []string{host}
-	req.Host = host
-
 	logger.Info("ServeHTTP")
-	httputil.NewSingleHostReverseProxy(&url.URL{
-		Scheme: "http",
-		Host:   ip.String(),
-	}).ServeHTTP(
-		w, req,
-	)
+	proxy.ServeHTTP(w, req, resolvedHost, 80, publicURL)
+}
+
+// getSubdomain returns the mDNS host label (or alias) from a host in the format
+// ${mdns_host}.${baseDomain}.
+func getSubdomain(host string, baseDomain string) (string, error) {
+	hostSlice := strings.Split(host, fmt.Sprintf(".%s", baseDomain))
+	if len(hostSlice) != 2 || hostSlice[1] != "" {
+		return "", fmt.Errorf("host must be in the format ${mdns_host}.%s, got: %s", baseDomain, host)
+	}
+	mdnsHost := hostSlice[0]
+	if mdnsHost == "" || len(strings.Split(mdnsHost, ".")) != 1 {
+		return "", fmt.Errorf("host must be in the format ${mdns_host}.%s, got: %s", baseDomain, host)
+	}
+	return mdnsHost, nil
+}
+
+// getMdnsHost returns the mDNS host name for a host label or alias, and whether access to
+// it is allowed by the host policy.
+func getMdnsHost(
+	ctx context.Context,
+	mdnsHost string,
+	service string,
+	mdnsDomain string,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	browse func(context.Context, string) ([]mdns.Service, error),
+) (string, bool, error) {
+	mdnsHost, known := hostAliases.Lookup(mdnsHost)
+	if !known && hostAliases.HasTxtKey() {
+		services, err := browse(ctx, service)
+		if err != nil {
+			return "", false, fmt.Errorf("Error querying mDNS: %v", err)
+		}
+		hostAliases.Learn(services)
+		mdnsHost, _ = hostAliases.Lookup(mdnsHost)
+	}
+	mdnsHost = fmt.Sprintf("%s.%s", mdnsHost, mdnsDomain)
+	allowed, err := hostPolicy.Allowed(ctx, mdnsHost, browse)
+	if err != nil {
+		return "", false, fmt.Errorf("Error checking host policy for '%s': %v", mdnsHost, err)
+	}
+	return mdnsHost, allowed, nil
 }
 
 func getRootRouter(
@@ -210,8 +328,47 @@ func getRootRouter(
 	mdnsDomain string,
 	timeout time.Duration,
 	proto mdns.Proto,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	proxy *Proxy,
+	trustedProxies *TrustedProxies,
+	routing *Routing,
+	compressor *Compressor,
+	forwardProxy *ForwardProxy,
 ) func(http.ResponseWriter, *http.Request) {
+	browse := getServiceBrowser(ifaceName, mdnsDomain, timeout, proto)
+
+	proxyMdnsHost := func(w http.ResponseWriter, req *http.Request, mdnsHost string) {
+		mdnsHost, allowed, err := getMdnsHost(
+			ctx, mdnsHost, service, mdnsDomain, hostAliases, hostPolicy, browse,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("Forbidden: host %s is not allowed", mdnsHost), http.StatusForbidden)
+			return
+		}
+		w, done := compressor.Wrap(w, req, mdnsHost)
+		defer done()
+		handleProxyMdnsHosts(
+			ctx,
+			baseDomain,
+			ifaceName,
+			mdnsDomain,
+			proto,
+			mdnsHost,
+			hostAliases,
+			routing,
+			proxy,
+			w,
+			req,
+		)
+	}
+
 	return func(w http.ResponseWriter, req *http.Request) {
+		req = trustedProxies.Apply(req)
 		logger := log.GetLogger(ctx)
 		logger.WithFields(logrus.Fields{
 			"Method":     req.Method,
@@ -222,13 +379,44 @@ func getRootRouter(
 			"RemoteAddr": req.RemoteAddr,
 		}).Info("Request received")
 
+		if forwardProxy.Handles(req) {
+			forwardProxy.ServeHTTP(w, req)
+			return
+		}
+
 		hostSlice := strings.Split(req.Host, ":")
 		host := hostSlice[0]
 		if host == baseDomain {
+			if forwardProxy.enabled && req.URL.Path == "/proxy.pac" {
+				forwardProxy.ServePAC(w, req)
+				return
+			}
+			if routing.mode == RoutingPath {
+				if alias, path, ok := routing.parsePath(req.URL.EscapedPath()); ok {
+					if path == "" {
+						redirectURL := *req.URL
+						redirectURL.Path = fmt.Sprintf("%s%s/", routing.pathPrefix, alias)
+						redirectURL.RawPath = ""
+						http.Redirect(w, req, redirectURL.RequestURI(), http.StatusPermanentRedirect)
+						return
+					}
+					pathURL, err := url.Parse(path)
+					if err != nil {
+						http.Error(w, fmt.Sprintf("Bad request: invalid path: %v", err), http.StatusBadRequest)
+						return
+					}
+					req.URL.Path = pathURL.Path
+					req.URL.RawPath = pathURL.RawPath
+					proxyMdnsHost(w, req, alias)
+					return
+				}
+			}
 			if req.URL.Path != "/" {
 				http.Error(w, "404 Not Found", http.StatusNotFound)
 				return
 			}
+			w, done := compressor.Wrap(w, req, "")
+			defer done()
 			handleListMdnsHosts(
 				ctx,
 				baseDomain,
@@ -237,34 +425,22 @@ func getRootRouter(
 				mdnsDomain,
 				timeout,
 				proto,
+				hostAliases,
+				hostPolicy,
+				routing,
 				w,
 				req,
 			)
 			return
 		}
 
-		if strings.HasSuffix(host, fmt.Sprintf(".%s", baseDomain)) {
-			hostSlice := strings.Split(host, fmt.Sprintf(".%s", baseDomain))
-			if len(hostSlice) != 2 {
-				http.Error(w, fmt.Sprintf("Bad request: host must be in the format ${mdns_host}.%s, got: %s", baseDomain, host), http.StatusBadRequest)
-				return
-			}
-			mdnsHost := hostSlice[0]
-			if len(strings.Split(mdnsHost, ".")) != 1 {
-				http.Error(w, fmt.Sprintf("Bad request: host must be in the format ${mdns_host}.%s, got: %s", baseDomain, host), http.StatusBadRequest)
+		if routing.mode == RoutingSubdomain && strings.HasSuffix(host, fmt.Sprintf(".%s", baseDomain)) {
+			mdnsHost, err := getSubdomain(host, baseDomain)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad request: %v", err), http.StatusBadRequest)
 				return
 			}
-			mdnsHost = fmt.Sprintf("%s.%s", mdnsHost, mdnsDomain)
-			req.Header["Host"] = []string{mdnsHost}
-			handleProxyMdnsHosts(
-				ctx,
-				baseDomain,
-				ifaceName,
-				mdnsDomain,
-				proto,
-				w,
-				req,
-			)
+			proxyMdnsHost(w, req, mdnsHost)
 			return
 		}
 
@@ -282,17 +458,19 @@ func NewServer(
 	timeout time.Duration,
 	disableIPv4 bool,
 	disableIPv6 bool,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	proxy *Proxy,
+	trustedProxies *TrustedProxies,
+	routing *Routing,
+	compressor *Compressor,
+	forwardProxy *ForwardProxy,
+	enableH2C bool,
 ) (
 	http.Server,
 	error,
 ) {
-	proto := mdns.ProtoAny
-	if disableIPv4 {
-		proto = mdns.ProtoInet6
-	}
-	if disableIPv6 {
-		proto = mdns.ProtoInet
-	}
+	proto := getProto(disableIPv4, disableIPv6)
 
 	serveMux := http.NewServeMux()
 	serveMux.HandleFunc("/", getRootRouter(
@@ -303,10 +481,27 @@ func NewServer(
 		mdnsDomain,
 		timeout,
 		proto,
+		hostAliases,
+		hostPolicy,
+		proxy,
+		trustedProxies,
+		routing,
+		compressor,
+		forwardProxy,
 	))
 
+	var handler http.Handler = serveMux
+	if enableH2C {
+		// HTTP/2 over TLS is enabled by net/http, but cleartext HTTP/2 (h2c) requires
+		// explicit support, either with prior knowledge or by upgrading from HTTP/1.1.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
 	return http.Server{
 		Addr:    addr,
-		Handler: serveMux,
+		Handler: handler,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
 	}, nil
 }
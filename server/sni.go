@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+var errSNIPeeked = errors.New("peeked at ClientHello")
+
+// readOnlyConn records data read from a connection, and refuses writes, so a TLS
+// ClientHello can be parsed without answering it.
+type readOnlyConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf.Write(b[:n])
+	return n, err
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekServerName reads the TLS ClientHello from conn, returning its server name, and a
+// connection which replays it.
+func peekServerName(ctx context.Context, conn net.Conn) (string, net.Conn, error) {
+	readOnly := &readOnlyConn{Conn: conn}
+	var serverName string
+	err := tls.Server(readOnly, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).HandshakeContext(ctx)
+	if !errors.Is(err, errSNIPeeked) {
+		return "", nil, fmt.Errorf("failed to read ClientHello: %w", err)
+	}
+	return serverName, &prefixedConn{
+		Conn:   conn,
+		reader: io.MultiReader(&readOnly.buf, conn),
+	}, nil
+}
+
+type prefixedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *prefixedConn) CloseWrite() error {
+	closeWrite(c.Conn)
+	return nil
+}
+
+// SNIRouter routes TLS connections to mDNS hosts, by the server name of the ClientHello
+// (${mdns_host}.${baseDomain}), without terminating TLS.
+type SNIRouter struct {
+	addr         string
+	baseDomain   string
+	ifaceName    string
+	service      string
+	mdnsDomain   string
+	proto        mdns.Proto
+	port         uint16
+	helloTimeout time.Duration
+	browse       func(context.Context, string) ([]mdns.Service, error)
+	hostAliases  *HostAliases
+	hostPolicy   *HostPolicy
+	streams      *Streams
+	dialContext  func(ctx context.Context, network, address string) (net.Conn, error)
+	listener     net.Listener
+}
+
+// NewSNIRouter creates a new SNIRouter, listening at addr, which connects to mDNS hosts
+// at port.
+//   - helloTimeout: how long to wait for the ClientHello.
+//   - streams: limits connections per client and host, and closes idle connections.
+func NewSNIRouter(
+	addr string,
+	baseDomain string,
+	ifaceName string,
+	service string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostAliases *HostAliases,
+	hostPolicy *HostPolicy,
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	dialTimeout time.Duration,
+	port uint16,
+	helloTimeout time.Duration,
+	streams *Streams,
+) *SNIRouter {
+	proto := getProto(disableIPv4, disableIPv6)
+	return &SNIRouter{
+		addr:         addr,
+		baseDomain:   baseDomain,
+		ifaceName:    ifaceName,
+		service:      service,
+		mdnsDomain:   mdnsDomain,
+		proto:        proto,
+		port:         port,
+		helloTimeout: helloTimeout,
+		browse:       getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostAliases:  hostAliases,
+		hostPolicy:   hostPolicy,
+		streams:      streams,
+		dialContext:  newUpstreamDialContext(upstreamPolicy, upstreamBinder, dialTimeout),
+	}
+}
+
+// Listen starts listening.
+func (r *SNIRouter) Listen() error {
+	listener, err := net.Listen("tcp", r.addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", r.addr, err)
+	}
+	r.listener = listener
+	return nil
+}
+
+// Serve accepts connections, until the listener is closed.
+func (r *SNIRouter) Serve(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	logger.Infof("Routing TLS connections on %s by server name", r.addr)
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("Error accepting connection on %s: %v", r.addr, err)
+			}
+			return
+		}
+		go r.handle(ctx, conn)
+	}
+}
+
+// Close stops listening. Open connections are kept until closed or idle.
+func (r *SNIRouter) Close() {
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
+
+// resolve returns the allowed mDNS host for serverName.
+func (r *SNIRouter) resolve(ctx context.Context, serverName string) (mdns.Host, error) {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if !strings.HasSuffix(serverName, fmt.Sprintf(".%s", r.baseDomain)) {
+		return mdns.Host{}, fmt.Errorf("unexpected server name: %#v", serverName)
+	}
+	label, err := getSubdomain(serverName, r.baseDomain)
+	if err != nil {
+		return mdns.Host{}, err
+	}
+	mdnsHost, allowed, err := getMdnsHost(
+		ctx, label, r.service, r.mdnsDomain, r.hostAliases, r.hostPolicy, r.browse,
+	)
+	if err != nil {
+		return mdns.Host{}, err
+	}
+	if !allowed {
+		return mdns.Host{}, fmt.Errorf("host %s is not allowed", mdnsHost)
+	}
+
+	m, err := mdns.NewMDNS()
+	if err != nil {
+		return mdns.Host{}, err
+	}
+	defer m.Close()
+	return m.ResolveHost(mdnsHost, r.ifaceName, r.proto)
+}
+
+func (r *SNIRouter) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"Client": conn.RemoteAddr().String(),
+		"Listen": r.addr,
+	})
+
+	helloCtx, cancel := context.WithTimeout(ctx, r.helloTimeout)
+	serverName, conn, err := peekServerName(helloCtx, conn)
+	cancel()
+	if err != nil {
+		logger.Warnf("Connection refused: %v", err)
+		return
+	}
+	logger = logger.WithField("ServerName", serverName)
+
+	host, err := r.resolve(ctx, serverName)
+	if err != nil {
+		logger.Warnf("Connection refused: %v", err)
+		return
+	}
+
+	// Limits are acquired before dialing, so refused connections do not reach hosts
+	release, err := r.streams.Acquire("tls", client, host.Name)
+	if err != nil {
+		logger.Warnf("Connection refused: %v", err)
+		return
+	}
+	defer release()
+
+	upstreamConn, err := r.dialContext(
+		withUpstreamInterface(ctx, host.Interface), "tcp", host.HostPort(r.port),
+	)
+	if err != nil {
+		logger.Errorf("Error connecting to target: %v", err)
+		return
+	}
+	defer upstreamConn.Close()
+	logger = logger.WithField("Upstream", upstreamConn.RemoteAddr().String())
+	logger.Info("TLS connection opened")
+
+	sent, received := splice(r.streams.WrapConn(conn), r.streams.WrapConn(upstreamConn))
+
+	logger.WithFields(logrus.Fields{
+		"Duration": time.Since(start).String(),
+		"Sent":     sent,
+		"Received": received,
+	}).Info("TLS connection closed")
+}
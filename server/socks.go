@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// socksHandshakeTimeout is how long clients have to authenticate and send their request.
+var socksHandshakeTimeout = 10 * time.Second
+
+const (
+	socksVersion = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksUserPassVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded          = 0x00
+	socksRepGeneralFailure     = 0x01
+	socksRepNotAllowed         = 0x02
+	socksRepHostUnreachable    = 0x04
+	socksRepConnectionRefused  = 0x05
+	socksRepCmdNotSupported    = 0x07
+	socksRepAtypNotSupported   = 0x08
+	socksUserPassStatusSuccess = 0x00
+	socksUserPassStatusFailure = 0x01
+)
+
+// ReadSOCKSUsersFile reads SOCKS users from a file, with one user:password per line.
+// Empty lines and lines starting with # are ignored.
+func ReadSOCKSUsersFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: must be in the format user:password", path, lineNumber)
+		}
+		users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SOCKSServer is a SOCKS5 server which only allows connections to mDNS hosts, by domain
+// name.
+type SOCKSServer struct {
+	addr        string
+	users       map[string]string
+	ifaceName   string
+	mdnsDomain  string
+	proto       mdns.Proto
+	browse      func(context.Context, string) ([]mdns.Service, error)
+	hostPolicy  *HostPolicy
+	streams     *Streams
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	listener    net.Listener
+}
+
+// NewSOCKSServer creates a new SOCKSServer listening at addr.
+//   - users: username to password. If empty, no authentication is required.
+//   - streams: limits connections per client and host, and closes idle connections.
+func NewSOCKSServer(
+	addr string,
+	users map[string]string,
+	ifaceName string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostPolicy *HostPolicy,
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	dialTimeout time.Duration,
+	streams *Streams,
+) (*SOCKSServer, error) {
+	for user, password := range users {
+		if len(user) == 0 || len(user) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("invalid user %#v: username and password must be up to 255 bytes", user)
+		}
+	}
+	proto := getProto(disableIPv4, disableIPv6)
+	return &SOCKSServer{
+		addr:        addr,
+		users:       users,
+		ifaceName:   ifaceName,
+		mdnsDomain:  mdnsDomain,
+		proto:       proto,
+		browse:      getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostPolicy:  hostPolicy,
+		streams:     streams,
+		dialContext: newUpstreamDialContext(upstreamPolicy, upstreamBinder, dialTimeout),
+	}, nil
+}
+
+// Listen starts listening.
+func (s *SOCKSServer) Listen() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", s.addr, err)
+	}
+	s.listener = listener
+	return nil
+}
+
+// Serve accepts connections, until the listener is closed.
+func (s *SOCKSServer) Serve(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	if len(s.users) == 0 {
+		logger.Warnf("SOCKS server on %s does not require authentication", s.addr)
+	}
+	logger.Infof("Starting SOCKS server on %s", s.addr)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Errorf("Error accepting connection on %s: %v", s.addr, err)
+			}
+			return
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+// Close stops listening. Open connections are kept until closed or idle.
+func (s *SOCKSServer) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *SOCKSServer) authenticate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNoAuth)
+	if len(s.users) > 0 {
+		method = socksMethodUserPass
+	}
+	var offered bool
+	for _, m := range methods {
+		if m == method {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return "", fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodNoAuth {
+		return "", nil
+	}
+
+	// RFC 1929
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksUserPassVersion {
+		return "", fmt.Errorf("unsupported username/password authentication version %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	passwordLen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, passwordLen); err != nil {
+		return "", err
+	}
+	password := make([]byte, passwordLen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	expected, ok := s.users[string(user)]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), password) != 1 {
+		conn.Write([]byte{socksUserPassVersion, socksUserPassStatusFailure})
+		return "", fmt.Errorf("invalid credentials for user %#v", string(user))
+	}
+	if _, err := conn.Write([]byte{socksUserPassVersion, socksUserPassStatusSuccess}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// readRequest reads a request, returning its command and destination.
+func (s *SOCKSServer) readRequest(conn net.Conn) (byte, byte, string, uint16, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, "", 0, err
+	}
+	if header[0] != socksVersion {
+		return 0, 0, "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		addrLen := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			addrLen = net.IPv6len
+		}
+		addr := make([]byte, addrLen)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return 0, 0, "", 0, err
+		}
+		host = net.IP(addr).String()
+	case socksAtypDomain:
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, domainLen); err != nil {
+			return 0, 0, "", 0, err
+		}
+		domain := make([]byte, domainLen[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return 0, 0, "", 0, err
+		}
+		host = string(domain)
+	default:
+		return 0, header[3], "", 0, nil
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return 0, 0, "", 0, err
+	}
+	return header[1], header[3], host, binary.BigEndian.Uint16(port), nil
+}
+
+func (s *SOCKSServer) reply(conn net.Conn, rep byte, bindAddr net.Addr) error {
+	ip := net.IPv4zero.To4()
+	var port uint16
+	if tcpAddr, ok := bindAddr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = uint16(tcpAddr.Port)
+	}
+	atyp := byte(socksAtypIPv4)
+	if len(ip) == net.IPv6len {
+		atyp = socksAtypIPv6
+	}
+	msg := append([]byte{socksVersion, rep, 0x00, atyp}, ip...)
+	msg = binary.BigEndian.AppendUint16(msg, port)
+	_, err := conn.Write(msg)
+	return err
+}
+
+func (s *SOCKSServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"Client": conn.RemoteAddr().String(),
+		"Listen": s.addr,
+	})
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	user, err := s.authenticate(conn)
+	if err != nil {
+		logger.Warnf("SOCKS authentication failed: %v", err)
+		return
+	}
+	if user != "" {
+		logger = logger.WithField("User", user)
+	}
+	cmd, atyp, host, port, err := s.readRequest(conn)
+	if err != nil {
+		logger.Warnf("Invalid SOCKS request: %v", err)
+		return
+	}
+	if host == "" {
+		s.reply(conn, socksRepAtypNotSupported, nil)
+		logger.Warnf("SOCKS request refused: unsupported address type %d", atyp)
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	logger = logger.WithField("Target", target)
+	if cmd != socksCmdConnect {
+		s.reply(conn, socksRepCmdNotSupported, nil)
+		logger.Warnf("SOCKS request refused: unsupported command %d", cmd)
+		return
+	}
+	if atyp != socksAtypDomain {
+		s.reply(conn, socksRepNotAllowed, nil)
+		logger.Warn("SOCKS request refused: only mDNS host names are allowed")
+		return
+	}
+	// Resolving and dialing have their own timeouts
+	conn.SetDeadline(time.Time{})
+
+	mdnsHost, err := resolveMdnsTarget(ctx, host, s.ifaceName, s.mdnsDomain, s.proto, s.hostPolicy, s.browse)
+	if err != nil {
+		rep := byte(socksRepGeneralFailure)
+		switch {
+		case errors.Is(err, errTargetNotAllowed):
+			rep = socksRepNotAllowed
+		case errors.Is(err, errTargetUnresolved):
+			rep = socksRepHostUnreachable
+		}
+		s.reply(conn, rep, nil)
+		logger.Warnf("SOCKS request refused: %v", err)
+		return
+	}
+
+	release, err := s.streams.Acquire("socks", client, mdnsHost.Name)
+	if err != nil {
+		s.reply(conn, socksRepNotAllowed, nil)
+		logger.Warnf("SOCKS request refused: %v", err)
+		return
+	}
+	defer release()
+
+	upstreamConn, err := s.dialContext(
+		withUpstreamInterface(ctx, mdnsHost.Interface), "tcp", mdnsHost.HostPort(port),
+	)
+	if err != nil {
+		s.reply(conn, socksRepConnectionRefused, nil)
+		logger.Errorf("Error connecting to target: %v", err)
+		return
+	}
+	defer upstreamConn.Close()
+	if err := s.reply(conn, socksRepSucceeded, upstreamConn.LocalAddr()); err != nil {
+		return
+	}
+
+	logger = logger.WithField("Upstream", upstreamConn.RemoteAddr().String())
+	logger.Info("SOCKS connection opened")
+	sent, received := splice(s.streams.WrapConn(conn), s.streams.WrapConn(upstreamConn))
+	logger.WithFields(logrus.Fields{
+		"Duration": time.Since(start).String(),
+		"Sent":     sent,
+		"Received": received,
+	}).Info("SOCKS connection closed")
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+var streamMetrics = expvar.NewMap("streams")
+
+var errStreamClientLimit = errors.New("too many streams from client")
+var errStreamHostLimit = errors.New("too many streams to host")
+
+var StreamWebSocket = "websocket"
+var StreamUpgrade = "upgrade"
+var StreamSSE = "sse"
+
+// getStreamKind returns the kind of long-lived stream the request is for, or an empty
+// string for regular requests.
+func getStreamKind(req *http.Request) string {
+	if httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade") {
+		if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+			return StreamWebSocket
+		}
+		return StreamUpgrade
+	}
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+			return StreamSSE
+		}
+	}
+	return ""
+}
+
+// Streams controls long-lived streams (WebSockets, other protocol upgrades and Server-Sent
+// Events), limiting how many of them are open per client and per host, and closing them
+// when idle or after a maximum lifetime.
+type Streams struct {
+	maxPerClient int
+	maxPerHost   int
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+
+	mutex   sync.Mutex
+	clients map[string]int
+	hosts   map[string]int
+}
+
+// NewStreams creates a new Streams. Zero values disable each limit or timeout.
+func NewStreams(
+	maxPerClient int,
+	maxPerHost int,
+	idleTimeout time.Duration,
+	maxLifetime time.Duration,
+) *Streams {
+	return &Streams{
+		maxPerClient: maxPerClient,
+		maxPerHost:   maxPerHost,
+		idleTimeout:  idleTimeout,
+		maxLifetime:  maxLifetime,
+		clients:      map[string]int{},
+		hosts:        map[string]int{},
+	}
+}
+
+// Acquire reserves a stream from client to host. On success, release must be called once
+// the stream is closed.
+func (s *Streams) Acquire(kind string, client string, host string) (release func(), err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.maxPerClient > 0 && s.clients[client] >= s.maxPerClient {
+		streamMetrics.Add("rejected_client_limit", 1)
+		return nil, errStreamClientLimit
+	}
+	if s.maxPerHost > 0 && s.hosts[host] >= s.maxPerHost {
+		streamMetrics.Add("rejected_host_limit", 1)
+		return nil, errStreamHostLimit
+	}
+	s.clients[client]++
+	s.hosts[host]++
+	streamMetrics.Add("total_"+kind, 1)
+	streamMetrics.Add("active_"+kind, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.clients[client]--
+			if s.clients[client] == 0 {
+				delete(s.clients, client)
+			}
+			s.hosts[host]--
+			if s.hosts[host] == 0 {
+				delete(s.hosts, host)
+			}
+			streamMetrics.Add("active_"+kind, -1)
+		})
+	}, nil
+}
+
+// WrapConn returns a connection which is closed when idle for longer than the idle timeout,
+// or when open for longer than the maximum lifetime.
+func (s *Streams) WrapConn(conn net.Conn) net.Conn {
+	c := &streamConn{
+		Conn:        conn,
+		idleTimeout: s.idleTimeout,
+	}
+	if s.idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(s.idleTimeout, func() {
+			streamMetrics.Add("closed_idle", 1)
+			c.Close()
+		})
+	}
+	if s.maxLifetime > 0 {
+		c.lifetimeTimer = time.AfterFunc(s.maxLifetime, func() {
+			streamMetrics.Add("closed_lifetime", 1)
+			c.Close()
+		})
+	}
+	return c
+}
+
+type streamConn struct {
+	net.Conn
+	idleTimeout   time.Duration
+	idleTimer     *time.Timer
+	lifetimeTimer *time.Timer
+}
+
+func (c *streamConn) active() {
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.active()
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+	return c.Conn.Close()
+}
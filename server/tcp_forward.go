@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/fornellas/mdns-proxy/log"
+	"github.com/fornellas/mdns-proxy/mdns"
+)
+
+// tcpTarget is where forwarded connections go to, either a host at a port, any instance
+// of a service type, or a named service instance.
+type tcpTarget struct {
+	host        string
+	port        uint16
+	serviceType string
+	serviceName string
+}
+
+func (t tcpTarget) String() string {
+	switch {
+	case t.host != "":
+		return fmt.Sprintf("host:%s", net.JoinHostPort(t.host, strconv.Itoa(int(t.port))))
+	case t.serviceName != "":
+		return fmt.Sprintf("instance:%s/%s", t.serviceType, t.serviceName)
+	default:
+		return fmt.Sprintf("service:%s", t.serviceType)
+	}
+}
+
+type tcpForward struct {
+	addr     string
+	target   tcpTarget
+	listener net.Listener
+}
+
+// TCPForwarder forwards TCP connections from listen addresses to mDNS hosts or services.
+type TCPForwarder struct {
+	forwards    []*tcpForward
+	ifaceName   string
+	mdnsDomain  string
+	proto       mdns.Proto
+	browse      func(context.Context, string) ([]mdns.Service, error)
+	hostPolicy  *HostPolicy
+	streams     *Streams
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	wg sync.WaitGroup
+}
+
+// NewTCPForwarder creates a new TCPForwarder.
+//   - forwards: in the format listen_address=target, where target is either
+//     host:<host>:<port>, service:<type> (eg: service:_mqtt._tcp) or
+//     instance:<type>/<name> (eg: instance:_ipp._tcp/Office Printer).
+//   - streams: limits connections per client and host, and closes idle connections.
+func NewTCPForwarder(
+	forwards []string,
+	ifaceName string,
+	mdnsDomain string,
+	timeout time.Duration,
+	disableIPv4 bool,
+	disableIPv6 bool,
+	hostPolicy *HostPolicy,
+	upstreamPolicy *UpstreamPolicy,
+	upstreamBinder *UpstreamBinder,
+	dialTimeout time.Duration,
+	streams *Streams,
+) (*TCPForwarder, error) {
+	proto := getProto(disableIPv4, disableIPv6)
+	f := &TCPForwarder{
+		ifaceName:   ifaceName,
+		mdnsDomain:  mdnsDomain,
+		proto:       proto,
+		browse:      getServiceBrowser(ifaceName, mdnsDomain, timeout, proto),
+		hostPolicy:  hostPolicy,
+		streams:     streams,
+		dialContext: newUpstreamDialContext(upstreamPolicy, upstreamBinder, dialTimeout),
+	}
+	for _, forward := range forwards {
+		addr, targetStr, ok := strings.Cut(forward, "=")
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("invalid forward %#v: must be in the format listen_address=target", forward)
+		}
+		target, err := f.parseTarget(targetStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward %#v: %w", forward, err)
+		}
+		f.forwards = append(f.forwards, &tcpForward{
+			addr:   addr,
+			target: target,
+		})
+	}
+	return f, nil
+}
+
+func (f *TCPForwarder) parseTarget(target string) (tcpTarget, error) {
+	kind, value, _ := strings.Cut(target, ":")
+	if value == "" {
+		return tcpTarget{}, fmt.Errorf("empty target")
+	}
+	switch kind {
+	case "host":
+		host, portStr, err := net.SplitHostPort(value)
+		if err != nil {
+			return tcpTarget{}, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return tcpTarget{}, fmt.Errorf("invalid port %#v", portStr)
+		}
+		host = strings.ToLower(host)
+		if !strings.HasSuffix(host, fmt.Sprintf(".%s", f.mdnsDomain)) {
+			host = fmt.Sprintf("%s.%s", host, f.mdnsDomain)
+		}
+		return tcpTarget{host: host, port: uint16(port)}, nil
+	case "service":
+		return tcpTarget{serviceType: value}, nil
+	case "instance":
+		serviceType, name, ok := strings.Cut(value, "/")
+		if !ok || serviceType == "" || name == "" {
+			return tcpTarget{}, fmt.Errorf("instance must be in the format <type>/<name>")
+		}
+		return tcpTarget{serviceType: serviceType, serviceName: name}, nil
+	default:
+		return tcpTarget{}, fmt.Errorf("unknown kind %#v: must be host, service or instance", kind)
+	}
+}
+
+// Listen starts listening on all forward addresses.
+func (f *TCPForwarder) Listen() error {
+	for _, forward := range f.forwards {
+		listener, err := net.Listen("tcp", forward.addr)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("error listening on %s: %w", forward.addr, err)
+		}
+		forward.listener = listener
+	}
+	return nil
+}
+
+// Serve accepts connections on all listeners, until they are closed.
+func (f *TCPForwarder) Serve(ctx context.Context) {
+	logger := log.GetLogger(ctx)
+	for _, forward := range f.forwards {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			logger.Infof("Forwarding TCP connections from %s to %s", forward.addr, forward.target)
+			for {
+				conn, err := forward.listener.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						logger.Errorf("Error accepting connection on %s: %v", forward.addr, err)
+					}
+					return
+				}
+				go f.handle(ctx, forward, conn)
+			}
+		}()
+	}
+	f.wg.Wait()
+}
+
+// Close stops listening. Open connections are kept until closed or idle.
+func (f *TCPForwarder) Close() {
+	for _, forward := range f.forwards {
+		if forward.listener != nil {
+			forward.listener.Close()
+		}
+	}
+}
+
+// getCandidates returns the allowed hosts and ports for target, in order of preference.
+func (f *TCPForwarder) getCandidates(ctx context.Context, target tcpTarget) ([]mdns.Host, []uint16, error) {
+	if target.host != "" {
+		allowed, err := f.hostPolicy.Allowed(ctx, target.host, f.browse)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			return nil, nil, fmt.Errorf("host %s is not allowed", target.host)
+		}
+		m, err := mdns.NewMDNS()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer m.Close()
+		host, err := m.ResolveHost(target.host, f.ifaceName, f.proto)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []mdns.Host{host}, []uint16{target.port}, nil
+	}
+
+	services, err := f.browse(ctx, target.serviceType)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.hostPolicy.Learn(target.serviceType, services)
+	sort.SliceStable(services, func(i, j int) bool {
+		if services[i].Name != services[j].Name {
+			return services[i].Name < services[j].Name
+		}
+		return services[i].Host < services[j].Host
+	})
+	hosts := []mdns.Host{}
+	ports := []uint16{}
+	for _, service := range services {
+		if target.serviceName != "" && service.Name != target.serviceName {
+			continue
+		}
+		allowed, err := f.hostPolicy.Allowed(ctx, service.Host, f.browse)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !allowed {
+			continue
+		}
+		hosts = append(hosts, mdns.Host{
+			Interface: service.Interface,
+			Protocol:  service.Protocol,
+			Name:      service.Host,
+			IP:        service.IP,
+		})
+		ports = append(ports, service.Port)
+	}
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("no allowed instances of %s found", target)
+	}
+	return hosts, ports, nil
+}
+
+// dial connects to the first candidate of target within the connection limits, which must
+// be released after the connection is closed. Limits are acquired before dialing, so refused
+// connections do not reach hosts.
+func (f *TCPForwarder) dial(
+	ctx context.Context,
+	target tcpTarget,
+	client string,
+) (net.Conn, mdns.Host, func(), error) {
+	hosts, ports, err := f.getCandidates(ctx, target)
+	if err != nil {
+		return nil, mdns.Host{}, nil, err
+	}
+	for i, host := range hosts {
+		var release func()
+		release, err = f.streams.Acquire("tcp", client, host.Name)
+		if err != nil {
+			if errors.Is(err, errStreamClientLimit) {
+				break
+			}
+			continue
+		}
+		var conn net.Conn
+		conn, err = f.dialContext(
+			withUpstreamInterface(ctx, host.Interface), "tcp", host.HostPort(ports[i]),
+		)
+		if err == nil {
+			return conn, host, release, nil
+		}
+		release()
+	}
+	return nil, mdns.Host{}, nil, err
+}
+
+func (f *TCPForwarder) handle(ctx context.Context, forward *tcpForward, conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	client, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		client = conn.RemoteAddr().String()
+	}
+	logger := log.GetLogger(ctx).WithFields(logrus.Fields{
+		"Client": conn.RemoteAddr().String(),
+		"Listen": forward.addr,
+		"Target": forward.target.String(),
+	})
+
+	upstreamConn, _, release, err := f.dial(ctx, forward.target, client)
+	if err != nil {
+		if errors.Is(err, errStreamClientLimit) || errors.Is(err, errStreamHostLimit) {
+			logger.Warnf("Connection refused: %v", err)
+		} else {
+			logger.Errorf("Error connecting to target: %v", err)
+		}
+		return
+	}
+	defer release()
+	defer upstreamConn.Close()
+	logger = logger.WithField("Upstream", upstreamConn.RemoteAddr().String())
+	logger.Info("TCP connection opened")
+
+	sent, received := splice(f.streams.WrapConn(conn), f.streams.WrapConn(upstreamConn))
+
+	logger.WithFields(logrus.Fields{
+		"Duration": time.Since(start).String(),
+		"Sent":     sent,
+		"Received": received,
+	}).Info("TCP connection closed")
+}
+
+// splice copies data between conn and upstreamConn in both directions, until both are
+// done, returning the number of bytes sent to and received from upstreamConn. Both are
+// expected to be wrapped by Streams.WrapConn, so a stalled side is closed when idle.
+func splice(conn net.Conn, upstreamConn net.Conn) (sent int64, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstreamConn, conn)
+		closeWrite(upstreamConn)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(conn, upstreamConn)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+// closeWrite signals the end of data to the peer, while still allowing reads.
+func closeWrite(conn net.Conn) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	if c, ok := conn.(closeWriter); ok {
+		c.CloseWrite()
+		return
+	}
+	if c, ok := conn.(*streamConn); ok {
+		closeWrite(c.Conn)
+		return
+	}
+	conn.Close()
+}
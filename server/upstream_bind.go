@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+type upstreamInterfaceKeyType string
+
+var upstreamInterfaceKey = upstreamInterfaceKeyType("upstreamInterface")
+
+// withUpstreamInterface returns a copy of the context with the interface where the
+// upstream host was discovered.
+func withUpstreamInterface(ctx context.Context, ifaceName string) context.Context {
+	return context.WithValue(ctx, upstreamInterfaceKey, ifaceName)
+}
+
+func getUpstreamInterface(ctx context.Context) string {
+	ifaceName, _ := ctx.Value(upstreamInterfaceKey).(string)
+	return ifaceName
+}
+
+var UpstreamBindNone = "none"
+var UpstreamBindDevice = "device"
+var UpstreamBindSourceAddress = "source-address"
+
+// UpstreamBinder binds upstream connections to a network interface, so traffic only
+// leaves through it.
+type UpstreamBinder struct {
+	mode      string
+	ifaceName string
+}
+
+// NewUpstreamBinder creates a new UpstreamBinder. mode can be:
+//   - UpstreamBindNone: connections are not bound.
+//   - UpstreamBindDevice: sockets are bound to the interface (eg: SO_BINDTODEVICE).
+//   - UpstreamBindSourceAddress: sockets are bound to an address of the interface.
+//
+// When ifaceName is empty, the interface where the upstream host was discovered is
+// used.
+func NewUpstreamBinder(mode string, ifaceName string) (*UpstreamBinder, error) {
+	switch mode {
+	case UpstreamBindNone, UpstreamBindDevice, UpstreamBindSourceAddress:
+	default:
+		return nil, fmt.Errorf(
+			"invalid bind mode %#v: must be one of %s, %s or %s",
+			mode, UpstreamBindNone, UpstreamBindDevice, UpstreamBindSourceAddress,
+		)
+	}
+	if ifaceName != "" {
+		if _, err := net.InterfaceByName(ifaceName); err != nil {
+			return nil, fmt.Errorf("invalid interface %#v: %w", ifaceName, err)
+		}
+	}
+	return &UpstreamBinder{
+		mode:      mode,
+		ifaceName: ifaceName,
+	}, nil
+}
+
+func getSourceAddress(ifaceName string, remote net.IP) (*net.TCPAddr, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	remoteIsIPv4 := remote.To4() != nil
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) != remoteIsIPv4 {
+			continue
+		}
+		if ipNet.IP.IsLinkLocalUnicast() != remote.IsLinkLocalUnicast() {
+			continue
+		}
+		localAddr := &net.TCPAddr{IP: ipNet.IP}
+		if !remoteIsIPv4 && ipNet.IP.IsLinkLocalUnicast() {
+			localAddr.Zone = ifaceName
+		}
+		return localAddr, nil
+	}
+	return nil, fmt.Errorf("interface %s has no address suitable to connect to %s", ifaceName, remote)
+}
+
+// Configure prepares the dialer to connect to address, through the interface either
+// configured or stored in the context.
+func (b *UpstreamBinder) Configure(ctx context.Context, dialer *net.Dialer, address string) error {
+	if b.mode == UpstreamBindNone {
+		return nil
+	}
+
+	ifaceName := b.ifaceName
+	if ifaceName == "" {
+		ifaceName = getUpstreamInterface(ctx)
+	}
+	if ifaceName == "" {
+		return fmt.Errorf("unable to bind connection to %s: unknown interface", address)
+	}
+
+	switch b.mode {
+	case UpstreamBindDevice:
+		control := dialer.Control
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+			var bindErr error
+			if err := c.Control(func(fd uintptr) {
+				bindErr = bindToDevice(fd, network, ifaceName)
+			}); err != nil {
+				return err
+			}
+			return bindErr
+		}
+	case UpstreamBindSourceAddress:
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ipAddr, err := net.ResolveIPAddr("ip", host)
+			if err != nil {
+				return err
+			}
+			ip = ipAddr.IP
+		}
+		localAddr, err := getSourceAddress(ifaceName, ip)
+		if err != nil {
+			return err
+		}
+		dialer.LocalAddr = localAddr
+	}
+	return nil
+}
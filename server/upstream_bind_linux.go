@@ -0,0 +1,9 @@
+package server
+
+import (
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, network string, ifaceName string) error {
+	return syscall.BindToDevice(int(fd), ifaceName)
+}
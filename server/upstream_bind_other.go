@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package server
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func bindToDevice(fd uintptr, network string, ifaceName string) error {
+	return fmt.Errorf("binding to a device is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// DefaultUpstreamDenyCIDRs are the networks upstream connections are denied to by
+// default: loopback, unspecified, cloud metadata services and multicast. Other link-local
+// addresses are allowed, as mDNS hosts without DHCP commonly use them.
+var DefaultUpstreamDenyCIDRs = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.169.254/32",
+	"224.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fd00:ec2::254/128",
+	"ff00::/8",
+}
+
+// UpstreamPolicy defines which addresses the proxy is allowed to connect to. It is
+// enforced at the dialer, so it applies to the address actually connected to, after
+// resolution.
+type UpstreamPolicy struct {
+	allow              []netip.Prefix
+	deny               []netip.Prefix
+	denyLocalAddresses bool
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %#v: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// NewUpstreamPolicy creates a new UpstreamPolicy. When allowCIDRs is not empty, only
+// addresses within them are allowed. Addresses within denyCIDRs are always denied, as
+// are addresses assigned to local interfaces when denyLocalAddresses is set.
+func NewUpstreamPolicy(
+	allowCIDRs []string,
+	denyCIDRs []string,
+	denyLocalAddresses bool,
+) (*UpstreamPolicy, error) {
+	allow, err := parsePrefixes(allowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parsePrefixes(denyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &UpstreamPolicy{
+		allow:              allow,
+		deny:               deny,
+		denyLocalAddresses: denyLocalAddresses,
+	}, nil
+}
+
+func isLocalAddress(addr netip.Addr) (bool, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, ifaceAddr := range ifaceAddrs {
+		ipNet, ok := ifaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		localAddr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		if localAddr.Unmap() == addr {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check returns an error if connecting to the given address is not allowed.
+func (p *UpstreamPolicy) Check(addr netip.Addr) error {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range p.deny {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("upstream address %s denied: within %s", addr, prefix)
+		}
+	}
+	if p.denyLocalAddresses {
+		local, err := isLocalAddress(addr)
+		if err != nil {
+			return err
+		}
+		if local {
+			return fmt.Errorf("upstream address %s denied: local address", addr)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, prefix := range p.allow {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("upstream address %s denied: not within allowed networks", addr)
+}
+
+// Control can be used as net.Dialer.Control to enforce the policy.
+func (p *UpstreamPolicy) Control(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	return p.Check(addrPort.Addr())
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestUpstreamPolicyCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		allow   []string
+		deny    []string
+		addr    string
+		allowed bool
+	}{
+		{name: "private IPv4", deny: DefaultUpstreamDenyCIDRs, addr: "192.168.1.10", allowed: true},
+		{name: "global IPv6", deny: DefaultUpstreamDenyCIDRs, addr: "2001:db8::1", allowed: true},
+		{name: "IPv4 link-local", deny: DefaultUpstreamDenyCIDRs, addr: "169.254.10.20", allowed: true},
+		{name: "IPv6 link-local", deny: DefaultUpstreamDenyCIDRs, addr: "fe80::1", allowed: true},
+		{name: "IPv6 link-local with zone", deny: DefaultUpstreamDenyCIDRs, addr: "fe80::1%eth0", allowed: true},
+		{name: "IPv4 metadata", deny: DefaultUpstreamDenyCIDRs, addr: "169.254.169.254"},
+		{name: "IPv6 metadata", deny: DefaultUpstreamDenyCIDRs, addr: "fd00:ec2::254"},
+		{name: "IPv4 loopback", deny: DefaultUpstreamDenyCIDRs, addr: "127.0.0.1"},
+		{name: "IPv4 mapped loopback", deny: DefaultUpstreamDenyCIDRs, addr: "::ffff:127.0.0.1"},
+		{name: "IPv6 loopback", deny: DefaultUpstreamDenyCIDRs, addr: "::1"},
+		{name: "IPv4 unspecified", deny: DefaultUpstreamDenyCIDRs, addr: "0.0.0.0"},
+		{name: "IPv6 unspecified", deny: DefaultUpstreamDenyCIDRs, addr: "::"},
+		{name: "IPv4 multicast", deny: DefaultUpstreamDenyCIDRs, addr: "224.0.0.251"},
+		{name: "IPv6 multicast", deny: DefaultUpstreamDenyCIDRs, addr: "ff02::fb"},
+		{name: "within allowed", allow: []string{"192.168.0.0/16"}, addr: "192.168.1.10", allowed: true},
+		{name: "outside allowed", allow: []string{"192.168.0.0/16"}, addr: "10.0.0.1"},
+		{name: "deny over allow", allow: []string{"192.168.0.0/16"}, deny: []string{"192.168.1.0/24"}, addr: "192.168.1.10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := NewUpstreamPolicy(tc.allow, tc.deny, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = policy.Check(netip.MustParseAddr(tc.addr))
+			if tc.allowed && err != nil {
+				t.Fatalf("expected %s to be allowed: %v", tc.addr, err)
+			}
+			if !tc.allowed && err == nil {
+				t.Fatalf("expected %s to be denied", tc.addr)
+			}
+		})
+	}
+}